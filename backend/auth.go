@@ -0,0 +1,131 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	PermRead   = "read"
+	PermWrite  = "write"
+	PermDelete = "delete"
+
+	// KeymapPrefix marks a permission on a keymap group instead of a glob.
+	KeymapPrefix = "keymap:"
+	// HashPrefix marks a password given as hex sha256.
+	HashPrefix = "sha256:"
+)
+
+var (
+	ErrAuthRequired     = errors.New("authorization required")
+	ErrAuthFailed       = errors.New("authorization failed")
+	ErrPermissionDenied = errors.New("permission denied")
+)
+
+type permission struct {
+	keymap string
+	glob   *regexp.Regexp
+}
+
+// User is a proxy user and what it may do on which measurements.
+type User struct {
+	Name     string
+	Admin    bool
+	password string
+	perms    map[string][]*permission
+}
+
+func NewUser(name string, cfg *UserConfig) (u *User, err error) {
+	u = &User{
+		Name:     name,
+		Admin:    cfg.Admin,
+		password: cfg.Password,
+		perms:    make(map[string][]*permission),
+	}
+	for perm, entries := range map[string][]string{
+		PermRead:   cfg.Read,
+		PermWrite:  cfg.Write,
+		PermDelete: cfg.Delete,
+	} {
+		for _, entry := range entries {
+			p := &permission{}
+			if strings.HasPrefix(entry, KeymapPrefix) {
+				p.keymap = strings.TrimPrefix(entry, KeymapPrefix)
+			} else {
+				p.glob, err = regexp.Compile(GlobToRegexp(entry))
+				if err != nil {
+					return
+				}
+			}
+			u.perms[perm] = append(u.perms[perm], p)
+		}
+	}
+	return
+}
+
+func (u *User) CheckPassword(password string) bool {
+	if strings.HasPrefix(u.password, HashPrefix) {
+		sum := sha256.Sum256([]byte(password))
+		password = HashPrefix + hex.EncodeToString(sum[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(u.password), []byte(password)) == 1
+}
+
+// Can tells whether the user has perm on a measurement routed by keymap.
+func (u *User) Can(perm string, measurement string, keymap string) bool {
+	if u.Admin {
+		return true
+	}
+	for _, p := range u.perms[perm] {
+		if p.glob != nil && p.glob.MatchString(measurement) {
+			return true
+		}
+		if p.glob == nil && p.keymap == keymap {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAll tells whether perm covers any measurement, as a regex source needs.
+func (u *User) CanAll(perm string) bool {
+	if u.Admin {
+		return true
+	}
+	for _, p := range u.perms[perm] {
+		if p.glob != nil && p.glob.String() == GlobToRegexp("*") {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCredentials reads u and p parameters first, then HTTP basic auth, as
+// InfluxDB does.
+func GetCredentials(req *http.Request) (username, password string, ok bool) {
+	q := req.URL.Query()
+	username, password = q.Get("u"), q.Get("p")
+	if username != "" {
+		return username, password, true
+	}
+	return req.BasicAuth()
+}
+
+// StripCredentials removes the client credentials, which are meant for
+// the proxy only.
+func StripCredentials(req *http.Request) {
+	if req.Form != nil {
+		req.Form.Del("u")
+		req.Form.Del("p")
+	}
+	req.Header.Del("Authorization")
+}
@@ -0,0 +1,132 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestUserPermissions(t *testing.T) {
+	u, err := NewUser("jdoe", &UserConfig{
+		Password: "sha256:" + "5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8", // "password"
+		Read:     []string{"cpu", "app.*", "keymap:_default_"},
+		Write:    []string{"cpu"},
+	})
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+
+	if !u.CheckPassword("password") || u.CheckPassword("passw0rd") {
+		t.Errorf("hashed password check failed")
+	}
+
+	tests := []struct {
+		perm        string
+		measurement string
+		keymap      string
+		want        bool
+	}{
+		{PermRead, "cpu", "cpu", true},
+		{PermRead, "app.web", "^app\\.", true},
+		{PermRead, "mem", "_default_", true},
+		{PermRead, "mem", "mem", false},
+		{PermWrite, "cpu", "cpu", true},
+		{PermWrite, "app.web", "^app\\.", false},
+		{PermDelete, "cpu", "cpu", false},
+	}
+	for _, tt := range tests {
+		if got := u.Can(tt.perm, tt.measurement, tt.keymap); got != tt.want {
+			t.Errorf("%s %s: got %v, want %v", tt.perm, tt.measurement, got, tt.want)
+		}
+	}
+	if u.CanAll(PermRead) {
+		t.Errorf("no catch-all read permission given")
+	}
+}
+
+func TestGetCredentials(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://localhost:8086/query?u=jdoe&p=secret", nil)
+	username, password, ok := GetCredentials(req)
+	if !ok || username != "jdoe" || password != "secret" {
+		t.Errorf("query credentials: %s %s %v", username, password, ok)
+	}
+
+	req, _ = http.NewRequest("GET", "http://localhost:8086/query", nil)
+	req.SetBasicAuth("jdoe", "basic")
+	username, password, ok = GetCredentials(req)
+	if !ok || username != "jdoe" || password != "basic" {
+		t.Errorf("basic credentials: %s %s %v", username, password, ok)
+	}
+
+	req, _ = http.NewRequest("GET", "http://localhost:8086/query", nil)
+	if _, _, ok = GetCredentials(req); ok {
+		t.Errorf("no credentials expected")
+	}
+}
+
+func TestInfluxClusterAuthorization(t *testing.T) {
+	cfg, ts := CreateTestBackendConfig(t, "test")
+	defer ts.Close()
+	config := &Config{
+		Proxy:    ProxyConfig{DataDir: t.TempDir()},
+		Backends: map[string]BackendConfig{"test": *cfg},
+		Keymaps:  map[string][]string{"cpu": {"test"}, "mem": {"test"}},
+		Users: map[string]UserConfig{
+			"reader": {Password: "r", Read: []string{"cpu"}},
+			"viewer": {Password: "v", Read: []string{"*"}},
+			"admin":  {Password: "a", Admin: true},
+		},
+	}
+	ic := NewInfluxCluster(config)
+	err := ic.Init()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer ic.Close()
+
+	tests := []struct {
+		name  string
+		query string
+		user  string
+		pass  string
+		want  int
+	}{
+		{"no_credentials", "SELECT * FROM cpu", "", "", 401},
+		{"bad_password", "SELECT * FROM cpu", "reader", "x", 401},
+		{"read", "SELECT * FROM cpu", "reader", "r", 204},
+		{"read_denied", "SELECT * FROM mem", "reader", "r", 403},
+		{"delete_denied", "DELETE FROM cpu WHERE time < now() - 1d", "reader", "r", 403},
+		{"regex_denied", "SELECT * FROM /.*/", "reader", "r", 403},
+		{"database_denied", "SHOW MEASUREMENTS", "reader", "r", 403},
+		{"database", "SHOW MEASUREMENTS", "viewer", "v", 200},
+		{"admin", "SELECT * FROM mem", "admin", "a", 204},
+	}
+	for _, tt := range tests {
+		q := url.Values{}
+		q.Set("q", tt.query)
+		if tt.user != "" {
+			q.Set("u", tt.user)
+			q.Set("p", tt.pass)
+		}
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+		w := NewDummyResponseWriter()
+		_ = ic.Query(w, req)
+		if w.status != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.status, tt.want)
+		}
+	}
+
+	reader, err := ic.Authenticate(httptest.NewRequest("POST", "/write?u=reader&p=r", nil))
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	err = ic.WriteWith([]byte("cpu value=1\n"), &WriteOptions{User: reader})
+	if err != ErrPermissionDenied {
+		t.Errorf("reader shouldn't write, got %v", err)
+	}
+}
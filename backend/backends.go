@@ -6,78 +6,177 @@ package backend
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	WriteQueue = 16
+	WriteQueue = 1024 // lines waiting for the worker, and as many for the spiller
+
+	OverloadSpill  = "spill"
+	OverloadReject = "reject"
+
+	DefaultMaxFlushes    = 8
+	DefaultMaxBufferSize = 64 * 1024 * 1024
+
+	replayMinBackoff = 100 * time.Millisecond
 )
 
+var (
+	ErrOverloaded            = errors.New("backend overloaded")
+	ErrInvalidOverloadPolicy = errors.New("invalid overload policy")
+)
+
+type writeItem struct {
+	key BatchKey
+	p   []byte
+	ack chan<- error // told once the batch is sent or spilled, and then flushed
+}
+
+// batch buffers the lines of one batch key until flushed.
+type batch struct {
+	buffer       bytes.Buffer
+	size         int64 // bytes written, counted in the buffer budget
+	writeCounter int32
+	acks         []chan<- error
+}
+
 type Backend struct {
 	*HttpBackend
 	Interval        int
 	RewriteInterval int
 	MaxRowLimit     int32
 
-	fileBackend     *FileBackend
-	running         bool
-	ticker          *time.Ticker
-	chWrite         chan []byte
-	buffer          *bytes.Buffer
-	chTimer         <-chan time.Time
-	writeCounter    int32
-	rewriterRunning bool
-	waitGroup       sync.WaitGroup
+	fileBackend       *FileBackend
+	deadLetters       *DeadLetterFile
+	dataLock          *dataLock
+	intake            sync.RWMutex // held to write to chWrite and chSpill, taken to close them
+	running           int32        // atomic
+	ticker            *time.Ticker
+	chWrite           chan *writeItem
+	chSpill           chan *writeItem // lines the worker had no room for
+	spillDone         chan struct{}
+	done              chan struct{} // closed once shut down
+	batches           map[BatchKey]*batch
+	chTimer           <-chan time.Time
+	flushes           chan struct{} // one a batch in flight
+	buffered          int64         // atomic, bytes batched or in flight
+	maxBufferSize     int64
+	overloadPolicy    string
+	replayConcurrency int
+	replayBytes       *rateLimiter
+	replayPoints      *rateLimiter
+	replayBackoff     int64 // atomic, nanoseconds to wait between windows
+	rewriterRunning   int32 // atomic
+	replayPaused      int32 // atomic
+	chRewrite         chan struct{}
+	replayed          int64 // atomic, records replayed
+	rateLock          sync.Mutex
+	rateSince         time.Time
+	rateReplayed      int64
+	replayRate        float64 // records a second
+	waitGroup         sync.WaitGroup
 }
 
 // maybe ch_timer is not the best way.
 func NewBackend(cfg *BackendConfig, name string) (bs *Backend, err error) {
+	switch cfg.OverloadPolicy {
+	case "", OverloadSpill, OverloadReject:
+	default:
+		return nil, ErrInvalidOverloadPolicy
+	}
+	path, err := dataPath(cfg.DataDir, name)
+	if err != nil {
+		return
+	}
+	lock, err := lockData(path)
+	if err != nil {
+		return
+	}
+	err = migrateData(name, path)
+	if err != nil {
+		lock.Unlock()
+		return
+	}
+	fileBackend, err := NewFileBackend(path, cfg)
+	if err != nil {
+		lock.Unlock()
+		return
+	}
+	deadLetters, err := NewDeadLetterFile(path, cfg.DeadLetterMaxSize)
+	if err != nil {
+		fileBackend.Close()
+		lock.Unlock()
+		return
+	}
+
+	// the backend is checked and written to only once its files are ready.
 	bs = &Backend{
-		HttpBackend: NewHttpBackend(cfg),
-		// FIXME: path...
+		HttpBackend:     NewHttpBackend(cfg),
 		Interval:        cfg.Interval,
 		RewriteInterval: cfg.RewriteInterval,
-		running:         true,
+		fileBackend:     fileBackend,
+		deadLetters:     deadLetters,
+		dataLock:        lock,
+		running:         1,
 		ticker:          time.NewTicker(time.Millisecond * time.Duration(cfg.RewriteInterval)),
-		chWrite:         make(chan []byte, WriteQueue),
-
-		rewriterRunning: false,
+		spillDone:       make(chan struct{}),
+		done:            make(chan struct{}),
+		batches:         make(map[BatchKey]*batch),
+		chRewrite:       make(chan struct{}, 1),
+		flushes:         make(chan struct{}, DefaultMaxFlushes),
+		maxBufferSize:   DefaultMaxBufferSize,
+		overloadPolicy:  OverloadSpill,
+		rateSince:       time.Now(),
 		MaxRowLimit:     int32(cfg.MaxRowLimit),
+
+		replayConcurrency: cfg.ReplayConcurrency,
+		replayBytes:       newRateLimiter(cfg.ReplayBytesRate),
+		replayPoints:      newRateLimiter(cfg.ReplayPointsRate),
 	}
-	bs.fileBackend, err = NewFileBackend(name)
-	if err != nil {
-		_ = bs.Close()
-		return nil, err
+	queue := cfg.WriteQueueSize
+	if queue <= 0 {
+		queue = WriteQueue
+	}
+	bs.chWrite = make(chan *writeItem, queue)
+	bs.chSpill = make(chan *writeItem, queue)
+	if bs.replayConcurrency <= 0 {
+		bs.replayConcurrency = 1
+	}
+	if cfg.MaxFlushes > 0 {
+		bs.flushes = make(chan struct{}, cfg.MaxFlushes)
+	}
+	if cfg.MaxBufferSize != 0 {
+		bs.maxBufferSize = cfg.MaxBufferSize
+	}
+	if cfg.OverloadPolicy != "" {
+		bs.overloadPolicy = cfg.OverloadPolicy
 	}
 	go bs.worker()
+	go bs.spiller()
 	return bs, nil
 }
 
+// worker batches the lines queued until Close, and then the lines still
+// queued, before it shuts the backend down.
 func (bs *Backend) worker() {
-	for bs.running {
+	for {
 		select {
-		case p, ok := <-bs.chWrite:
+		case item, ok := <-bs.chWrite:
 			if !ok {
-				// closed
+				// closed, and drained.
 				bs.Flush()
-				bs.waitGroup.Wait()
-				_ = bs.HttpBackend.Close()
-				bs.fileBackend.Close()
+				bs.shutdown()
 				return
 			}
-			bs.WriteBuffer(p)
+			bs.WriteBuffer(item.p, item.key, item.ack)
 
 		case <-bs.chTimer:
 			bs.Flush()
-			if !bs.running {
-				bs.waitGroup.Wait()
-				_ = bs.HttpBackend.Close()
-				bs.fileBackend.Close()
-				return
-			}
 
 		case <-bs.ticker.C:
 			bs.Idle()
@@ -85,50 +184,137 @@ func (bs *Backend) worker() {
 	}
 }
 
-func (bs *Backend) Write(p []byte) (err error) {
-	if !bs.running {
-		return io.ErrClosedPipe
+// shutdown waits for the batches in flight and the spiller, so that every
+// writer waiting is told, then closes the backend and its files.
+func (bs *Backend) shutdown() {
+	bs.ticker.Stop()
+	bs.waitGroup.Wait()
+	<-bs.spillDone
+	_ = bs.HttpBackend.Close()
+	bs.fileBackend.Close()
+	bs.deadLetters.Close()
+	bs.dataLock.Unlock()
+	close(bs.done)
+}
+
+// spiller writes the lines the worker had no room for to the spill queue,
+// a record a batch key for all it finds queued, so that a stalled backend
+// costs its writers no more than a channel send.
+func (bs *Backend) spiller() {
+	defer close(bs.spillDone)
+	batches := make(map[BatchKey]*batch)
+	add := func(item *writeItem) {
+		b, ok := batches[item.key]
+		if !ok {
+			b = &batch{}
+			batches[item.key] = b
+		}
+		b.add(item.p, item.ack)
 	}
 
-	bs.chWrite <- p
-	return
+	for open := true; open; {
+		item, ok := <-bs.chSpill
+		if !ok {
+			return
+		}
+		add(item)
+	drain:
+		for n := 1; n < int(bs.MaxRowLimit); n++ {
+			select {
+			case item, ok = <-bs.chSpill:
+				if !ok {
+					open = false
+					break drain
+				}
+				add(item)
+			default:
+				break drain
+			}
+		}
+
+		for key, b := range batches {
+			delete(batches, key)
+			b.done(&bs.buffered, bs.spill(b.buffer.Bytes(), key))
+		}
+	}
 }
 
-func (bs *Backend) Close() (err error) {
-	bs.running = false
-	close(bs.chWrite)
-	return
+// Write writes p with the default batch key of the backend.
+func (bs *Backend) Write(p []byte) (err error) {
+	return bs.WriteKey(p, BatchKey{})
+}
+
+func (bs *Backend) WriteKey(p []byte, key BatchKey) (err error) {
+	return bs.enqueue(&writeItem{key: key, p: p})
 }
 
-func (bs *Backend) WriteBuffer(p []byte) {
-	bs.writeCounter++
+// WriteSync writes p and flushes its batch at once. ack gets nil when the
+// backend or the spill file has accepted the batch, the error otherwise,
+// so it must have room not to block the sender.
+func (bs *Backend) WriteSync(p []byte, key BatchKey, ack chan<- error) (err error) {
+	return bs.enqueue(&writeItem{key: key, p: p, ack: ack})
+}
 
-	if bs.buffer == nil {
-		bs.buffer = &bytes.Buffer{}
+// enqueue hands an item to the worker without blocking, unless the buffer
+// budget is spent or the worker is behind. Then the item goes to the
+// spiller, or is refused with ErrOverloaded, as the overload policy says.
+// It is refused as well if the spiller is behind too.
+func (bs *Backend) enqueue(item *writeItem) (err error) {
+	bs.intake.RLock()
+	defer bs.intake.RUnlock()
+	if atomic.LoadInt32(&bs.running) == 0 {
+		return io.ErrClosedPipe
 	}
 
-	n, err := bs.buffer.Write(p)
-	if err != nil {
-		log.Printf("error: %s\n", err)
-		return
+	size := int64(len(item.p))
+	buffered := atomic.AddInt64(&bs.buffered, size)
+	if bs.maxBufferSize < 0 || buffered <= bs.maxBufferSize {
+		select {
+		case bs.chWrite <- item:
+			return
+		default:
+		}
 	}
-	if n != len(p) {
-		err = io.ErrShortWrite
-		log.Printf("error: %s\n", err)
+
+	if bs.overloadPolicy == OverloadReject {
+		atomic.AddInt64(&bs.buffered, -size)
+		return ErrOverloaded
+	}
+	select {
+	case bs.chSpill <- item:
 		return
+	default:
 	}
+	atomic.AddInt64(&bs.buffered, -size)
+	return ErrOverloaded
+}
 
-	if p[len(p)-1] != '\n' {
-		_, err = bs.buffer.Write([]byte{'\n'})
-		if err != nil {
-			log.Printf("error: %s\n", err)
-			return
-		}
+// Close refuses new writes. The lines queued are still sent or spilled,
+// and their writers told, then the backend shuts down. It returns once the
+// data of the backend is closed, for another backend to open it.
+func (bs *Backend) Close() (err error) {
+	bs.intake.Lock()
+	if atomic.LoadInt32(&bs.running) != 0 {
+		atomic.StoreInt32(&bs.running, 0)
+		close(bs.chWrite)
+		close(bs.chSpill)
 	}
+	bs.intake.Unlock()
+	<-bs.done
+	return
+}
+
+func (bs *Backend) WriteBuffer(p []byte, key BatchKey, ack chan<- error) {
+	b, ok := bs.batches[key]
+	if !ok {
+		b = &batch{}
+		bs.batches[key] = b
+	}
+	b.add(p, ack)
 
 	switch {
-	case bs.writeCounter >= bs.MaxRowLimit:
-		bs.Flush()
+	case ack != nil, b.writeCounter >= bs.MaxRowLimit:
+		bs.flushBatch(key)
 	case bs.chTimer == nil:
 		bs.chTimer = time.After(
 			time.Millisecond * time.Duration(bs.Interval))
@@ -137,114 +323,345 @@ func (bs *Backend) WriteBuffer(p []byte) {
 	return
 }
 
+// Flush sends every batch.
 func (bs *Backend) Flush() {
-	if bs.buffer == nil {
-		return
+	bs.chTimer = nil
+	for key := range bs.batches {
+		bs.flushBatch(key)
 	}
+}
 
-	p := bs.buffer.Bytes()
-	bs.buffer = nil
-	bs.chTimer = nil
-	bs.writeCounter = 0
+func (bs *Backend) flushBatch(key BatchKey) {
+	b, ok := bs.batches[key]
+	if !ok {
+		return
+	}
+	delete(bs.batches, key)
 
+	p := b.buffer.Bytes()
 	if len(p) == 0 {
+		b.done(&bs.buffered, nil)
 		return
 	}
 
-	// TODO: limitation
+	select {
+	case bs.flushes <- struct{}{}:
+	default:
+		if bs.overloadPolicy == OverloadSpill {
+			// too many batches in flight, the backend is slow.
+			err := bs.spill(p, key)
+			b.done(&bs.buffered, err)
+			return
+		}
+		// wait, and so make the writers wait or be refused.
+		bs.flushes <- struct{}{}
+	}
+
 	bs.waitGroup.Add(1)
 	go func() {
 		defer bs.waitGroup.Done()
-		var buf bytes.Buffer
-		err := Compress(&buf, p)
-		if err != nil {
-			log.Printf("write file error: %s\n", err)
+		err := bs.send(key, p)
+		<-bs.flushes
+		b.done(&bs.buffered, err)
+	}()
+
+	return
+}
+
+// add appends lines to the batch, ending them with a newline.
+func (b *batch) add(p []byte, ack chan<- error) {
+	b.writeCounter += int32(bytes.Count(p, []byte{'\n'}))
+	b.size += int64(len(p))
+	if ack != nil {
+		b.acks = append(b.acks, ack)
+	}
+
+	b.buffer.Write(p)
+	if len(p) > 0 && p[len(p)-1] != '\n' {
+		b.buffer.WriteByte('\n')
+		b.writeCounter++
+	}
+}
+
+// done gives the bytes of the batch back to the budget, and tells err to
+// the writers waiting.
+func (b *batch) done(buffered *int64, err error) {
+	atomic.AddInt64(buffered, -b.size)
+	for _, ack := range b.acks {
+		ack <- err
+	}
+}
+
+// send writes a batch to the backend, or to the spill file if the backend
+// is down, and tells whether it was accepted by one of them.
+func (bs *Backend) send(key BatchKey, p []byte) (err error) {
+	// maybe blocked here, run in another goroutine
+	if bs.HttpBackend.IsActive() {
+		err = bs.writeRaw(p, key)
+		switch {
+		case err == nil:
+			return
+		case errors.Is(err, ErrBadRequest):
+			log.Printf("bad request, split the batch: %s\n", err)
+			return bs.bisect(p, key, err, true)
+		case errors.Is(err, ErrNotFound):
+			log.Printf("bad backend, dead-letter all data.")
+			if derr := bs.deadLetter(p, key, err); derr != nil {
+				return derr
+			}
 			return
+		default:
+			log.Printf("unknown error %s, maybe overloaded.", err)
 		}
+		log.Printf("write http error: %s\n", err)
+	}
+	return bs.spill(p, key)
+}
 
-		p = buf.Bytes()
+func (bs *Backend) writeRaw(p []byte, key BatchKey) (err error) {
+	var buf bytes.Buffer
+	err = Compress(&buf, p)
+	if err != nil {
+		log.Printf("compress error: %s\n", err)
+		return
+	}
+	return bs.HttpBackend.WriteCompressed(buf.Bytes(), key)
+}
 
-		// maybe blocked here, run in another goroutine
-		if bs.HttpBackend.IsActive() {
-			err = bs.HttpBackend.WriteCompressed(p)
-			switch err {
-			case nil:
-				return
-			case ErrBadRequest:
-				log.Printf("bad request, drop all data.")
-				return
-			case ErrNotFound:
-				log.Printf("bad backend, drop all data.")
-				return
-			default:
-				log.Printf("unknown error %s, maybe overloaded.", err)
-			}
-			log.Printf("write http error: %s\n", err)
+func (bs *Backend) spill(p []byte, key BatchKey) (err error) {
+	var buf bytes.Buffer
+	err = Compress(&buf, p)
+	if err != nil {
+		log.Printf("write file error: %s\n", err)
+		return
+	}
+
+	err = bs.fileBackend.Write(encodeRecord(key, buf.Bytes()))
+	if err != nil {
+		log.Printf("write file error: %s\n", err)
+	}
+	// don't try to run rewrite loop directly.
+	// that need a lock.
+	return
+}
+
+// RejectedError tells the lines of a batch refused for good, which went to
+// the dead-letter file. The other lines of the batch were written.
+type RejectedError struct {
+	Lines [][]byte
+	Err   error // the refusal of the last line
+}
+
+func (e *RejectedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RejectedError) Unwrap() error {
+	return e.Err
+}
+
+// bisect writes the halves of a batch refused with 400 again, and so on
+// until the refused lines are alone and go to the dead-letter file. It
+// returns a RejectedError of the dead lines, if any. A half failing
+// otherwise is spilled if spill, or else its error is returned for the
+// caller to try the batch again. Lines InfluxDB wrote along with a refusal
+// are written twice, harmless unless they lack a timestamp.
+func (bs *Backend) bisect(p []byte, key BatchKey, cause error, spill bool) (err error) {
+	lines := bytes.SplitAfter(bytes.TrimRight(p, "\n"), []byte{'\n'})
+	if len(lines) <= 1 {
+		log.Printf("dead letter: %s\n", cause)
+		err = bs.deadLetter(p, key, cause)
+		if err != nil {
+			return
 		}
+		return &RejectedError{Lines: [][]byte{bytes.TrimSpace(p)}, Err: cause}
+	}
 
-		err = bs.fileBackend.Write(p)
+	var dead *RejectedError
+	mid := len(lines) / 2
+	for _, half := range [][][]byte{lines[:mid], lines[mid:]} {
+		part := bytes.Join(half, nil)
+		err = bs.writeRaw(part, key)
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrBadRequest):
+			err = bs.bisect(part, key, err, spill)
+			var rejected *RejectedError
+			if errors.As(err, &rejected) {
+				if dead == nil {
+					dead = &RejectedError{}
+				}
+				dead.Lines = append(dead.Lines, rejected.Lines...)
+				dead.Err, err = rejected.Err, nil
+			}
+		case spill:
+			err = bs.spill(part, key)
+		}
 		if err != nil {
-			log.Printf("write file error: %s\n", err)
+			return
 		}
-		// don't try to run rewrite loop directly.
-		// that need a lock.
-	}()
+	}
+	if dead == nil {
+		return nil
+	}
+	return dead
+}
 
-	return
+// deadLetter keeps every line of p, refused for cause.
+func (bs *Backend) deadLetter(p []byte, key BatchKey, cause error) (err error) {
+	var letters []*DeadLetter
+	for _, line := range bytes.Split(p, []byte{'\n'}) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		letters = append(letters, NewDeadLetter(key, line, cause))
+	}
+	if len(letters) == 0 {
+		return
+	}
+	return bs.deadLetters.Write(letters...)
+}
+
+func (bs *Backend) DeadLetters() (df *DeadLetterFile) {
+	return bs.deadLetters
 }
 
 func (bs *Backend) Idle() {
-	if !bs.rewriterRunning && bs.fileBackend.IsData() {
-		bs.rewriterRunning = true
-		go bs.RewriteLoop()
+	bs.updateReplayRate()
+	err := bs.fileBackend.Expire()
+	if err != nil {
+		log.Printf("expire spill queue error: %s\n", err)
 	}
+	bs.startRewrite()
 
 	// TODO: report counter
 }
 
+// startRewrite runs the rewrite loop unless it runs already, is paused,
+// or there is nothing to rewrite.
+func (bs *Backend) startRewrite() {
+	if atomic.LoadInt32(&bs.replayPaused) != 0 || !bs.fileBackend.IsData() {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&bs.rewriterRunning, 0, 1) {
+		go bs.RewriteLoop()
+	}
+}
+
 func (bs *Backend) RewriteLoop() {
+	defer atomic.StoreInt32(&bs.rewriterRunning, 0)
+	forced := false
 	for bs.fileBackend.IsData() {
-		if !bs.running {
+		if atomic.LoadInt32(&bs.running) == 0 || atomic.LoadInt32(&bs.replayPaused) != 0 {
 			return
 		}
-		if !bs.HttpBackend.IsActive() {
-			time.Sleep(time.Millisecond * time.Duration(bs.RewriteInterval))
+		if !forced && !bs.HttpBackend.IsActive() {
+			forced = bs.sleep(time.Millisecond * time.Duration(bs.RewriteInterval))
 			continue
 		}
+		forced = false
 		err := bs.Rewrite()
-		if err != nil {
-			time.Sleep(time.Millisecond * time.Duration(bs.RewriteInterval))
-			continue
+		if backoff := time.Duration(atomic.LoadInt64(&bs.replayBackoff)); err != nil || backoff > 0 {
+			forced = bs.sleep(backoff)
 		}
 	}
-	bs.rewriterRunning = false
 }
 
+// sleep waits for d, and tells whether a rewrite was forced meanwhile.
+func (bs *Backend) sleep(d time.Duration) (forced bool) {
+	select {
+	case <-time.After(d):
+		return false
+	case <-bs.chRewrite:
+		return true
+	}
+}
+
+// backoff doubles the wait between windows of replay when the backend
+// fails, up to the rewrite interval, and halves it when it accepts them.
+func (bs *Backend) backoff(failed bool) {
+	d := time.Duration(atomic.LoadInt64(&bs.replayBackoff))
+	switch {
+	case failed && d < replayMinBackoff:
+		d = replayMinBackoff
+	case failed:
+		d *= 2
+		if max := time.Millisecond * time.Duration(bs.RewriteInterval); d > max {
+			d = max
+		}
+	case d/2 < replayMinBackoff:
+		d = 0
+	default:
+		d /= 2
+	}
+	atomic.StoreInt64(&bs.replayBackoff, int64(d))
+}
+
+// Rewrite replays a window of records from the spill queue, up to the
+// replay concurrency, all at once. Replay moves past the records up to the
+// first one which failed, which is sent again with the rest of the window
+// from then on, so that every record is delivered at least once. Only a
+// concurrency of 1 keeps them in order.
 func (bs *Backend) Rewrite() (err error) {
-	p, err := bs.fileBackend.Read()
-	if err != nil {
-		return
+	defer func() {
+		bs.backoff(err != nil)
+	}()
+
+	var records [][]byte
+	var ends []Position // where each record ends
+	for len(records) < bs.replayConcurrency {
+		p, err := bs.fileBackend.Read()
+		if err != nil {
+			rerr := bs.fileBackend.RollbackMeta()
+			if rerr != nil {
+				log.Printf("rollback meta error: %s\n", rerr)
+			}
+			return err
+		}
+		if p == nil {
+			break
+		}
+		records = append(records, p)
+		ends = append(ends, bs.fileBackend.Position())
 	}
-	if p == nil { // why?
-		return
+	if len(records) == 0 {
+		// nothing left but corrupt records, skipped.
+		return bs.fileBackend.UpdateMeta()
 	}
 
-	err = bs.HttpBackend.WriteCompressed(p)
+	errs := make([]error, len(records))
+	var wg sync.WaitGroup
+	for i, p := range records {
+		wg.Add(1)
+		go func(i int, p []byte) {
+			defer wg.Done()
+			errs[i] = bs.replay(p)
+		}(i, p)
+	}
+	wg.Wait()
 
-	switch err {
-	case nil:
-	case ErrBadRequest:
-		log.Printf("bad request, drop all data.")
-		err = nil
-	case ErrNotFound:
-		log.Printf("bad backend, drop all data.")
-		err = nil
-	default:
+	sent := 0
+	for sent < len(records) && errs[sent] == nil {
+		sent++
+	}
+	if sent < len(records) {
+		err = errs[sent]
 		log.Printf("unknown error %s, maybe overloaded.", err)
-
-		err = bs.fileBackend.RollbackMeta()
-		if err != nil {
-			log.Printf("rollback meta error: %s\n", err)
+		if sent > 0 {
+			rerr := bs.fileBackend.Rewind(ends[sent-1])
+			if rerr == nil {
+				rerr = bs.fileBackend.UpdateMeta()
+			}
+			if rerr == nil {
+				atomic.AddInt64(&bs.replayed, int64(sent))
+				return
+			}
+			log.Printf("update meta error: %s\n", rerr)
+		}
+		rerr := bs.fileBackend.RollbackMeta()
+		if rerr != nil {
+			log.Printf("rollback meta error: %s\n", rerr)
 		}
 		return
 	}
@@ -254,5 +671,66 @@ func (bs *Backend) Rewrite() (err error) {
 		log.Printf("update meta error: %s\n", err)
 		return
 	}
+	atomic.AddInt64(&bs.replayed, int64(len(records)))
+	return
+}
+
+// replay sends a record of the spill queue within the replay rates. The
+// lines of a record refused for good are dead letters. It returns the
+// errors worth trying again.
+func (bs *Backend) replay(record []byte) (err error) {
+	key, p, err := decodeRecord(record)
+	if err == ErrBadRecord {
+		log.Printf("bad record, drop all data.")
+		return nil
+	}
+	if err != nil {
+		return
+	}
+
+	var raw []byte
+	if bs.replayPoints != nil {
+		raw, err = Decompress(p)
+		if err != nil {
+			log.Printf("bad record, drop all data: %s\n", err)
+			return nil
+		}
+		bs.replayPoints.wait(bytes.Count(raw, []byte{'\n'}))
+	}
+	bs.replayBytes.wait(len(p))
+
+	err = bs.HttpBackend.WriteCompressed(p, key)
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrBadRequest):
+		log.Printf("bad request, split the batch: %s\n", err)
+		cause := err
+		raw, err = Decompress(p)
+		if err != nil {
+			log.Printf("bad record, drop all data: %s\n", err)
+			return nil
+		}
+		// a half failing but for a refusal is sent again with the record,
+		// rather than spilled behind the records after it.
+		err = bs.bisect(raw, key, cause, false)
+		if err != nil && !errors.Is(err, ErrBadRequest) {
+			log.Printf("split batch error: %s\n", err)
+			return
+		}
+		return nil
+	case errors.Is(err, ErrNotFound):
+		log.Printf("bad backend, dead-letter all data.")
+		cause := err
+		raw, err = Decompress(p)
+		if err != nil {
+			log.Printf("bad record, drop all data: %s\n", err)
+			return nil
+		}
+		err = bs.deadLetter(raw, key, cause)
+		if err != nil {
+			log.Printf("dead letter error: %s\n", err)
+		}
+		return
+	}
 	return
 }
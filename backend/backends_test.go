@@ -5,12 +5,23 @@
 package backend
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 func TestCache(t *testing.T) {
-	cfg, ts := CreateTestBackendConfig("test")
+	cfg, ts := CreateTestBackendConfig(t, "test")
 	defer ts.Close()
 	bs, err := NewBackend(cfg, "test")
 	if err != nil {
@@ -36,7 +47,7 @@ func TestCache(t *testing.T) {
 }
 
 func TestRewrite(t *testing.T) {
-	cfg, ts := CreateTestBackendConfig("test")
+	cfg, ts := CreateTestBackendConfig(t, "test")
 	defer ts.Close()
 	bs, err := NewBackend(cfg, "test")
 	if err != nil {
@@ -53,3 +64,447 @@ func TestRewrite(t *testing.T) {
 	}
 	time.Sleep(2 * time.Second)
 }
+
+func TestBisect(t *testing.T) {
+	var lock sync.Mutex
+	var written []string
+	cfg, ts := CreateTestBackendConfig(t, "test")
+	defer ts.Close()
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/write" {
+			HandlerAny(w, req)
+			return
+		}
+		zip, _ := gzip.NewReader(req.Body)
+		p, _ := ioutil.ReadAll(zip)
+		if bytes.Contains(p, []byte("bad")) {
+			w.WriteHeader(400)
+			_, _ = w.Write([]byte(`{"error":"field type conflict"}`))
+			return
+		}
+		lock.Lock()
+		written = append(written, strings.Fields(string(p))...)
+		lock.Unlock()
+		w.WriteHeader(204)
+	})
+	bs, err := NewBackend(cfg, "bisect")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer bs.Close()
+
+	ack := make(chan error, 1)
+	err = bs.WriteSync([]byte("a v=1\nb v=1\nbad v=1\nc v=1\nd v=1\n"), BatchKey{DB: "test"}, ack)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if err = <-ack; !errors.Is(err, ErrBadRequest) {
+		t.Errorf("want the refusal acked, got %v", err)
+	}
+
+	lock.Lock()
+	sort.Strings(written)
+	if strings.Join(written, " ") != "a b c d v=1 v=1 v=1 v=1" {
+		t.Errorf("written: %v", written)
+	}
+	lock.Unlock()
+
+	p, err := ioutil.ReadFile(filepath.Join(cfg.DataDir, "bisect.dlq"))
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	var dl DeadLetter
+	if err = json.Unmarshal(p, &dl); err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if dl.Line != "bad v=1" || dl.DB != "test" || dl.Reason != "Bad Request: field type conflict" {
+		t.Errorf("dead letter: %+v", dl)
+	}
+}
+
+func TestBackendCloseQueued(t *testing.T) {
+	cfg, ts := CreateTestBackendConfig(t, "test")
+	defer ts.Close()
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		HandlerAny(w, req)
+	})
+	cfg.MaxFlushes = 1
+	cfg.OverloadPolicy = OverloadReject
+	bs, err := NewBackend(cfg, "closequeued")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+
+	// writers racing with Close are refused, not crashed.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_ = bs.Write([]byte("mem value=1\n"))
+			}
+		}()
+	}
+
+	var acks []chan error
+	for i := 0; i < 3; i++ {
+		ack := make(chan error, 1)
+		err = bs.WriteSync([]byte("cpu value=1\n"), BatchKey{DB: "test"}, ack)
+		if err != nil {
+			t.Fatalf("error: %s", err)
+		}
+		acks = append(acks, ack)
+	}
+	_ = bs.Close()
+	wg.Wait()
+
+	for i, ack := range acks {
+		select {
+		case err = <-ack:
+			if err != nil {
+				t.Errorf("write %d: %s", i, err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("write %d not told after close", i)
+		}
+	}
+	if err = bs.Write([]byte("cpu value=1\n")); err != io.ErrClosedPipe {
+		t.Errorf("want a closed backend, got %v", err)
+	}
+}
+
+func TestBackendQueue(t *testing.T) {
+	cfg, ts := CreateTestBackendConfig(t, "spillqueue")
+	defer ts.Close()
+	cfg.RewriteInterval = 60000
+	bs, err := NewBackend(cfg, "spillqueue")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer bs.Close()
+
+	bs.PauseReplay()
+	for i := 0; i < 3; i++ {
+		err = bs.spill([]byte("cpu value=1\n"), BatchKey{DB: "test"})
+		if err != nil {
+			t.Fatalf("error: %s", err)
+		}
+	}
+	bs.Idle()
+	stat, err := bs.QueueStat()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if stat.Records != 3 || stat.Segments != 1 || stat.Oldest == nil || !stat.Paused || stat.Replaying {
+		t.Errorf("stat: %+v", stat)
+	}
+	if err = bs.ForceRewrite(); err != ErrReplayPaused {
+		t.Errorf("want replay paused, got %v", err)
+	}
+
+	bs.ResumeReplay()
+	if err = bs.ForceRewrite(); err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	for i := 0; i < 100 && bs.fileBackend.IsData(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stat, err = bs.QueueStat()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if stat.Records != 0 || stat.Bytes != 0 || stat.Replayed != 3 {
+		t.Errorf("stat after replay: %+v", stat)
+	}
+
+	bs.PauseReplay()
+	_ = bs.spill([]byte("cpu value=1\n"), BatchKey{DB: "test"})
+	err = bs.PurgeQueue()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if stat, _ = bs.QueueStat(); stat.Records != 0 || bs.fileBackend.IsData() {
+		t.Errorf("stat after purge: %+v", stat)
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var lock sync.Mutex
+	var written []string
+	inflight, most := 0, 0
+	failed := false
+	cfg, ts := CreateTestBackendConfig(t, "test")
+	defer ts.Close()
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/write" {
+			HandlerAny(w, req)
+			return
+		}
+		lock.Lock()
+		inflight++
+		if inflight > most {
+			most = inflight
+		}
+		lock.Unlock()
+		time.Sleep(50 * time.Millisecond)
+
+		lock.Lock()
+		defer lock.Unlock()
+		inflight--
+		zip, _ := gzip.NewReader(req.Body)
+		p, _ := ioutil.ReadAll(zip)
+		line := strings.TrimSpace(string(p))
+		if line == "b v=1" && !failed {
+			failed = true
+			w.WriteHeader(500)
+			return
+		}
+		written = append(written, line)
+		w.WriteHeader(204)
+	})
+	cfg.ReplayConcurrency = 2
+	bs, err := NewBackend(cfg, "window")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer bs.Close()
+	bs.PauseReplay()
+
+	for _, line := range []string{"a v=1", "b v=1", "c v=1", "d v=1", "e v=1"} {
+		err = bs.spill([]byte(line+"\n"), BatchKey{DB: "test"})
+		if err != nil {
+			t.Fatalf("error: %s", err)
+		}
+	}
+
+	// the second record fails, and replay goes on from it.
+	if err = bs.Rewrite(); err == nil {
+		t.Errorf("want an error")
+	}
+	if backoff := time.Duration(bs.replayBackoff); backoff != replayMinBackoff {
+		t.Errorf("backoff %s", backoff)
+	}
+	for i := 0; i < 2; i++ {
+		err = bs.Rewrite()
+		if err != nil {
+			t.Fatalf("error: %s", err)
+		}
+	}
+	if backoff := time.Duration(bs.replayBackoff); backoff != 0 {
+		t.Errorf("backoff %s after success", backoff)
+	}
+	if bs.fileBackend.IsData() {
+		t.Errorf("replay not done")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	sort.Strings(written)
+	if strings.Join(written, ",") != "a v=1,b v=1,c v=1,d v=1,e v=1" {
+		t.Errorf("written: %v", written)
+	}
+	if most != 2 {
+		t.Errorf("%d records sent at once", most)
+	}
+}
+
+func TestReplayBisect(t *testing.T) {
+	var lock sync.Mutex
+	var written []string
+	failed := false
+	cfg, ts := CreateTestBackendConfig(t, "test")
+	defer ts.Close()
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/write" {
+			HandlerAny(w, req)
+			return
+		}
+		zip, _ := gzip.NewReader(req.Body)
+		p, _ := ioutil.ReadAll(zip)
+		lock.Lock()
+		defer lock.Unlock()
+		switch {
+		case bytes.Contains(p, []byte("bad")):
+			w.WriteHeader(400)
+			_, _ = w.Write([]byte(`{"error":"field type conflict"}`))
+		case !failed:
+			failed = true
+			w.WriteHeader(500)
+		default:
+			written = append(written, strings.TrimSpace(string(p)))
+			w.WriteHeader(204)
+		}
+	})
+	bs, err := NewBackend(cfg, "replaybisect")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer bs.Close()
+	bs.PauseReplay()
+
+	for _, p := range []string{"a v=1\nbad v=1\n", "b v=1\n"} {
+		err = bs.spill([]byte(p), BatchKey{DB: "test"})
+		if err != nil {
+			t.Fatalf("error: %s", err)
+		}
+	}
+
+	// the good half fails, the record is sent again rather than the half
+	// spilled behind the next one.
+	if err = bs.Rewrite(); err == nil {
+		t.Errorf("want an error")
+	}
+	for bs.fileBackend.IsData() {
+		if err = bs.Rewrite(); err != nil {
+			t.Fatalf("error: %s", err)
+		}
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if strings.Join(written, ",") != "a v=1,b v=1" {
+		t.Errorf("written: %v", written)
+	}
+	var lines []string
+	err = bs.deadLetters.Each(func(dl *DeadLetter) bool {
+		lines = append(lines, dl.Line)
+		return true
+	})
+	if err != nil || strings.Join(lines, ",") != "bad v=1" {
+		t.Errorf("dead letters: %v %v", lines, err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(10)
+	if d := rl.reserve(10); d != 0 {
+		t.Errorf("waits %s for a burst", d)
+	}
+	if d := rl.reserve(5); d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Errorf("waits %s for half a second", d)
+	}
+	if newRateLimiter(0).reserve(1000) != 0 {
+		t.Errorf("unlimited waits")
+	}
+}
+
+func TestBackendOverload(t *testing.T) {
+	release := make(chan struct{})
+	cfg, ts := CreateTestBackendConfig(t, "test")
+	defer ts.Close()
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" {
+			<-release
+			w.WriteHeader(204)
+			return
+		}
+		HandlerAny(w, req)
+	})
+	cfg.MaxFlushes = 1
+	cfg.MaxBufferSize = 16
+	bs, err := NewBackend(cfg, "overload")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer bs.Close()
+	defer close(release)
+	bs.PauseReplay()
+
+	// the first batch takes the only flush, the second is spilled.
+	for i := 0; i < 2; i++ {
+		ack := make(chan error, 1)
+		err = bs.WriteSync([]byte("cpu value=1\n"), BatchKey{DB: "test"}, ack)
+		if err != nil {
+			t.Fatalf("error: %s", err)
+		}
+		if i == 1 {
+			if err = <-ack; err != nil {
+				t.Errorf("spill error: %s", err)
+			}
+		}
+	}
+	// over the buffer budget, handed to the spiller.
+	ack := make(chan error, 1)
+	err = bs.WriteSync([]byte("cpu value=1,more=2,andmore=3"), BatchKey{DB: "test"}, ack)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if err = <-ack; err != nil {
+		t.Errorf("spill error: %s", err)
+	}
+	stat, _ := bs.QueueStat()
+	if stat.Records != 2 {
+		t.Errorf("spilled %d records, want 2", stat.Records)
+	}
+
+	bs.overloadPolicy = OverloadReject
+	err = bs.WriteKey([]byte("cpu value=1,more=2,andmore=3"), BatchKey{DB: "test"})
+	if err != ErrOverloaded {
+		t.Errorf("want overloaded, got %v", err)
+	}
+
+	bad := *cfg
+	bad.OverloadPolicy = "drop"
+	_, err = NewBackend(&bad, "overload")
+	if err != ErrInvalidOverloadPolicy {
+		t.Errorf("want an invalid policy, got %v", err)
+	}
+}
+
+func TestBackendStalled(t *testing.T) {
+	release := make(chan struct{})
+	cfg, ts := CreateTestBackendConfig(t, "test")
+	defer ts.Close()
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" {
+			<-release
+			w.WriteHeader(204)
+			return
+		}
+		HandlerAny(w, req)
+	})
+	cfg.MaxFlushes = 1
+	cfg.WriteQueueSize = 1
+	bs, err := NewBackend(cfg, "stalled")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer bs.Close()
+	defer close(release)
+	bs.PauseReplay()
+
+	// the first batch takes the only flush, the worker is stuck telling
+	// the second spilled to a writer who doesn't listen.
+	key := BatchKey{DB: "test"}
+	_ = bs.WriteSync([]byte("cpu value=1\n"), key, make(chan error, 1))
+	stuck := make(chan error)
+	_ = bs.WriteSync([]byte("cpu value=2\n"), key, stuck)
+
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		err = bs.WriteKey([]byte("cpu value=3\n"), key)
+		if err != nil && err != ErrOverloaded {
+			t.Fatalf("error: %s", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("writes to a stalled backend took %s", elapsed)
+	}
+
+	ack := make(chan error, 1)
+	for bs.WriteSync([]byte("cpu value=4\n"), key, ack) == ErrOverloaded {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err = <-ack; err != nil {
+		t.Errorf("spill error: %s", err)
+	}
+	stat, _ := bs.QueueStat()
+	if stat.Records < 2 {
+		t.Errorf("spilled %d records, want the lines behind the stall", stat.Records)
+	}
+	<-stuck
+}
@@ -0,0 +1,119 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/url"
+)
+
+const (
+	// recordKeyed starts a spilled record whose batch key is saved with it.
+	// Records of older versions are bare gzip data, starting 0x1f 0x8b.
+	recordKeyed = 0x01
+)
+
+var (
+	ErrBadRecord          = errors.New("bad record")
+	ErrInvalidPrecision   = errors.New("invalid precision")
+	ErrInvalidConsistency = errors.New("invalid consistency")
+)
+
+// precisions maps the precisions InfluxDB accepts to the one a batch is
+// sent with, nanoseconds being the default.
+var precisions = map[string]string{
+	"":   "",
+	"n":  "",
+	"ns": "",
+	"u":  "u",
+	"µ":  "u",
+	"ms": "ms",
+	"s":  "s",
+	"m":  "m",
+	"h":  "h",
+}
+
+var consistencies = map[string]bool{
+	"":       true,
+	"any":    true,
+	"one":    true,
+	"quorum": true,
+	"all":    true,
+}
+
+// BatchKey is what lines are written with. Lines of different keys never
+// share a batch. Empty fields fall back to the defaults of the backend.
+type BatchKey struct {
+	DB          string
+	RP          string
+	Precision   string
+	Consistency string
+}
+
+// NewBatchKey checks the write parameters, and normalizes the precision so
+// that lines of equal precision share a batch.
+func NewBatchKey(db, rp, precision, consistency string) (key BatchKey, err error) {
+	p, ok := precisions[precision]
+	if !ok {
+		return key, ErrInvalidPrecision
+	}
+	if !consistencies[consistency] {
+		return key, ErrInvalidConsistency
+	}
+	return BatchKey{DB: db, RP: rp, Precision: p, Consistency: consistency}, nil
+}
+
+// Values are the write query parameters of the key, db aside.
+func (key BatchKey) Values() (q url.Values) {
+	q = url.Values{}
+	if key.RP != "" {
+		q.Set("rp", key.RP)
+	}
+	if key.Precision != "" {
+		q.Set("precision", key.Precision)
+	}
+	if key.Consistency != "" {
+		q.Set("consistency", key.Consistency)
+	}
+	return
+}
+
+func encodeRecord(key BatchKey, p []byte) (record []byte) {
+	q := key.Values()
+	if key.DB != "" {
+		q.Set("db", key.DB)
+	}
+	header := q.Encode()
+
+	record = make([]byte, 1+binary.MaxVarintLen64, 1+binary.MaxVarintLen64+len(header)+len(p))
+	record[0] = recordKeyed
+	n := binary.PutUvarint(record[1:], uint64(len(header)))
+	record = record[:1+n]
+	record = append(record, header...)
+	return append(record, p...)
+}
+
+func decodeRecord(record []byte) (key BatchKey, p []byte, err error) {
+	if len(record) == 0 || record[0] != recordKeyed {
+		return key, record, nil
+	}
+	length, n := binary.Uvarint(record[1:])
+	if n <= 0 || uint64(len(record)-1-n) < length {
+		return key, nil, ErrBadRecord
+	}
+	header := record[1+n : 1+n+int(length)]
+	q, err := url.ParseQuery(string(header))
+	if err != nil {
+		return key, nil, ErrBadRecord
+	}
+	key = BatchKey{
+		DB:          q.Get("db"),
+		RP:          q.Get("rp"),
+		Precision:   q.Get("precision"),
+		Consistency: q.Get("consistency"),
+	}
+	return key, record[1+n+int(length):], nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+)
+
+func TestNewBatchKey(t *testing.T) {
+	tests := []struct {
+		precision   string
+		consistency string
+		want        string
+		err         error
+	}{
+		{"", "", "", nil},
+		{"n", "", "", nil},
+		{"ns", "one", "", nil},
+		{"µ", "", "u", nil},
+		{"ms", "quorum", "ms", nil},
+		{"s", "", "s", nil},
+		{"h", "all", "h", nil},
+		{"d", "", "", ErrInvalidPrecision},
+		{"s", "some", "", ErrInvalidConsistency},
+	}
+	for _, tt := range tests {
+		key, err := NewBatchKey("db", "", tt.precision, tt.consistency)
+		if err != tt.err {
+			t.Errorf("%s %s: got %v, want %v", tt.precision, tt.consistency, err, tt.err)
+			continue
+		}
+		if err == nil && key.Precision != tt.want {
+			t.Errorf("%s: precision %s, want %s", tt.precision, key.Precision, tt.want)
+		}
+	}
+}
+
+func TestRecord(t *testing.T) {
+	key := BatchKey{DB: "db2", RP: "week", Precision: "s", Consistency: "one"}
+	record := encodeRecord(key, []byte{0x1f, 0x8b, 1, 2, 3})
+	got, p, err := decodeRecord(record)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if got != key || string(p) != string([]byte{0x1f, 0x8b, 1, 2, 3}) {
+		t.Errorf("decoded %v %v", got, p)
+	}
+
+	// records spilled before batch keys are bare gzip data
+	got, p, err = decodeRecord([]byte{0x1f, 0x8b, 1})
+	if err != nil || got != (BatchKey{}) || len(p) != 3 {
+		t.Errorf("legacy record decoded %v %v %v", got, p, err)
+	}
+}
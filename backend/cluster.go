@@ -5,62 +5,54 @@
 package backend
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"io"
 	"log"
 	"net/http"
 	"os"
-	"regexp"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
 
+	"github.com/influxdata/influxql"
 	"influx_proxy/monitor"
 )
 
 var (
-	ErrBackendNotExist = errors.New("use a backend not exists")
-	ErrQueryForbidden  = errors.New("query forbidden")
+	ErrBackendNotExist    = errors.New("use a backend not exists")
+	ErrQueryForbidden     = errors.New("query forbidden")
+	ErrUnknownMeasurement = errors.New("unknown measurement")
+	ErrUnmergeableShards  = errors.New("aggregate or limit over shards, pin or group by the shard tags")
 )
 
-func ScanKey(pointBuf []byte) (key string, err error) {
-	var keyBuf [100]byte
-	keySlice := keyBuf[0:0]
-	bufLen := len(pointBuf)
-	for i := 0; i < bufLen; i++ {
-		c := pointBuf[i]
-		switch c {
-		case '\\':
-			i++
-			keySlice = append(keySlice, pointBuf[i])
-		case ' ', ',':
-			key = string(keySlice)
-			return
-		default:
-			keySlice = append(keySlice, c)
-		}
-	}
-	return "", io.EOF
-}
-
 type InfluxCluster struct {
-	config                *Config
-	lock                  sync.RWMutex
-	zone                  string
-	queryExecutor         Queryable
-	ForbiddenQuery        []*regexp.Regexp
-	ObligatedQuery        []*regexp.Regexp
-	backends              map[string]BackendApi   // backendName to backend
-	measurementToBackends map[string][]BackendApi // measurements to backends
-	stats                 *Statistics
-	counter               *Statistics
-	ticker                *time.Ticker
-	tags                  map[string]string
-	WriteTracing          int
-	QueryTracing          int
+	config          *Config
+	lock            sync.RWMutex
+	zone            string
+	queryExecutor   Queryable
+	policy          *Policy
+	users           map[string]*User
+	backends        map[string]BackendApi  // backendName to backend
+	defaultRoutes   *routeTable            // the top-level keymaps
+	routes          map[string]*routeTable // database to its routing table
+	deadLetters     *DeadLetterFile        // lines refused by the proxy
+	stats           *Statistics
+	counter         *Statistics
+	ticker          *time.Ticker
+	tags            map[string]string
+	WriteTracing    int
+	QueryTracing    int
+	SyncWrite       int
+	WriteWorkers    int   // chunks of a write parsed at once
+	MaxBodySize     int64 // bytes of a write body, 0 for no limit
+	QueryHedgeDelay int   // milliseconds, 0 not to hedge queries
+	QueryRace       int
 }
 
 type Statistics struct {
@@ -81,6 +73,10 @@ type ClusterMetadata struct {
 	Backends              map[string]*BackendConfig `json:"backends"`
 	BackendStatus         map[string]bool           `json:"backendStatus"`
 	MeasurementToBackends map[string][]string       `json:"measurementToBackends"`
+	PatternKeymaps        []PatternKeymap           `json:"patternKeymaps"`
+	ShardKeymaps          map[string]ShardKeymap    `json:"shardKeymaps"`
+	Databases             map[string]DatabaseConfig `json:"databases,omitempty"`
+	Routes                []*RouteMetadata          `json:"routes,omitempty"`
 }
 
 func NewInfluxCluster(config *Config) (ic *InfluxCluster) {
@@ -93,6 +89,15 @@ func NewInfluxCluster(config *Config) (ic *InfluxCluster) {
 		tags:         map[string]string{"addr": config.Proxy.ListenAddr},
 		WriteTracing: config.Proxy.WriteTracing,
 		QueryTracing: config.Proxy.QueryTracing,
+		SyncWrite:    config.Proxy.SyncWrite,
+		WriteWorkers: config.Proxy.WriteWorkers,
+		MaxBodySize:  config.Proxy.MaxBodySize,
+
+		QueryHedgeDelay: config.Proxy.QueryHedgeDelay,
+		QueryRace:       config.Proxy.QueryRace,
+	}
+	if ic.WriteWorkers <= 0 {
+		ic.WriteWorkers = runtime.NumCPU()
 	}
 	host, err := os.Hostname()
 	if err != nil {
@@ -103,15 +108,9 @@ func NewInfluxCluster(config *Config) (ic *InfluxCluster) {
 		ic.ticker = time.NewTicker(time.Second * time.Duration(config.Proxy.Interval))
 	}
 
-	err = ic.ForbidQuery(ForbidCommands)
-	if err != nil {
-		panic(err)
-		return
-	}
-	err = ic.EnsureQuery(SupportCommands)
+	ic.policy, err = NewPolicy(&config.Policy)
 	if err != nil {
 		panic(err)
-		return
 	}
 
 	// feature
@@ -171,42 +170,41 @@ func (ic *InfluxCluster) WriteStatistics() (err error) {
 	return ic.Write([]byte(line + "\n"))
 }
 
-func (ic *InfluxCluster) ForbidQuery(s string) (err error) {
-	r, err := regexp.Compile(s)
-	if err != nil {
-		return
-	}
-
-	ic.lock.Lock()
-	defer ic.lock.Unlock()
-	ic.ForbiddenQuery = append(ic.ForbiddenQuery, r)
-	return
-}
-
-func (ic *InfluxCluster) EnsureQuery(s string) (err error) {
-	r, err := regexp.Compile(s)
-	if err != nil {
-		return
-	}
-
-	ic.lock.Lock()
-	defer ic.lock.Unlock()
-	ic.ObligatedQuery = append(ic.ObligatedQuery, r)
-	return
-}
+// GetClusterMetadata also reports the matched rule of each measurement given,
+// in the routing table of db.
+func (ic *InfluxCluster) GetClusterMetadata(db string, measurements []string) (metadata *ClusterMetadata, err error) {
+	ic.lock.RLock()
+	config, backends := ic.config, ic.backends
+	ic.lock.RUnlock()
 
-func (ic *InfluxCluster) GetClusterMetadata() (metadata *ClusterMetadata, err error) {
 	metadata = &ClusterMetadata{}
 	metadata.Backends = make(map[string]*BackendConfig)
-	for name, config := range ic.config.Backends {
-		metadata.Backends[name] = &config
+	for name, config := range config.Backends {
+		cfg := config
+		cfg.Password = ""
+		metadata.Backends[name] = &cfg
 	}
 	metadata.BackendStatus = make(map[string]bool)
 	for backendName, _ := range metadata.Backends {
-		metadata.BackendStatus[backendName] = ic.backends[backendName].IsActive()
+		if bs, ok := backends[backendName]; ok {
+			metadata.BackendStatus[backendName] = bs.IsActive()
+		}
+	}
+	metadata.MeasurementToBackends = config.Keymaps
+	metadata.PatternKeymaps = config.PatternKeymaps
+	metadata.ShardKeymaps = config.ShardKeymaps
+	metadata.Databases = config.Databases
+	metadata.Proxy = &config.Proxy
+	if len(measurements) == 0 {
+		return
+	}
+	rt, ok := ic.getRoutes(db)
+	if !ok {
+		return nil, ErrDatabaseNotFound
+	}
+	for _, measurement := range measurements {
+		metadata.Routes = append(metadata.Routes, rt.GetRoute(measurement))
 	}
-	metadata.MeasurementToBackends = ic.config.Keymaps
-	metadata.Proxy = &ic.config.Proxy
 	return
 }
 
@@ -216,104 +214,333 @@ func (ic *InfluxCluster) loadBackends() (backends map[string]BackendApi, err err
 	backendConfigs := ic.config.Backends
 	var cnt = 0
 	for name, cfg := range backendConfigs {
-		backends[name], err = NewBackend(&cfg, name)
+		if cfg.DataDir == "" {
+			cfg.DataDir = ic.config.Proxy.DataDir
+		}
+		if cfg.DeadLetterMaxSize == 0 {
+			cfg.DeadLetterMaxSize = ic.config.Proxy.DeadLetterMaxSize
+		}
+		var bs *Backend
+		bs, err = NewBackend(&cfg, name)
 		if err != nil {
 			log.Printf("Create backend error: %s", err)
-			return
+			closeBackends(backends)
+			return nil, err
 		}
+		backends[name] = bs
 		cnt += 1
 	}
 	log.Printf("%d backends loaded.", cnt)
 	return
 }
 
-func (ic *InfluxCluster) loadMeasurements(backends map[string]BackendApi) (measurementToBackends map[string][]BackendApi, err error) {
-	measurementToBackends = make(map[string][]BackendApi)
+// loadRoutes builds the top-level routing table, then one per database.
+func (ic *InfluxCluster) loadRoutes(backends map[string]BackendApi) (defaultRoutes *routeTable, routes map[string]*routeTable, err error) {
+	defaultRoutes, err = newRouteTable(ic.config.Proxy.DB, ic.config.DefaultDatabase(), backends)
+	if err != nil {
+		return
+	}
 
-	measurementMap := ic.config.Keymaps
-	var cnt = 0
-	for measurementName, backendNames := range measurementMap {
-		var backendList []BackendApi
-		for _, backendName := range backendNames {
-			backend, ok := backends[backendName]
-			if !ok {
-				err = ErrBackendNotExist
-				log.Println(backendName, err)
-				continue
-			}
-			backendList = append(backendList, backend)
+	routes = make(map[string]*routeTable)
+	if ic.config.Proxy.DB != "" {
+		routes[ic.config.Proxy.DB] = defaultRoutes
+	}
+	for db := range ic.config.Databases {
+		cfg := ic.config.Databases[db]
+		routes[db], err = newRouteTable(db, &cfg, backends)
+		if err != nil {
+			log.Printf("load database %s error: %s", db, err)
+			return
 		}
-		cnt += 1
-		measurementToBackends[measurementName] = backendList
 	}
-	log.Printf("%d measurements loaded.", cnt)
+	log.Printf("%d databases loaded.", len(routes))
+	return
+}
+
+func (ic *InfluxCluster) loadUsers() (users map[string]*User, err error) {
+	users = make(map[string]*User)
+	for name := range ic.config.Users {
+		cfg := ic.config.Users[name]
+		users[name], err = NewUser(name, &cfg)
+		if err != nil {
+			log.Printf("load user %s error: %s", name, err)
+			return
+		}
+	}
+	log.Printf("%d users loaded.", len(users))
 	return
 }
 
 func (ic *InfluxCluster) Init() (err error) {
+	policy, err := NewPolicy(&ic.config.Policy)
+	if err != nil {
+		log.Printf("load policy error: %s", err)
+		return
+	}
+
+	users, err := ic.loadUsers()
+	if err != nil {
+		return
+	}
+
+	// the backends in use drain into their data and close it, before the
+	// new ones open it.
+	ic.lock.RLock()
+	originBackends := ic.backends
+	ic.lock.RUnlock()
+	closeBackends(originBackends)
+
 	backends, err := ic.loadBackends()
 	if err != nil {
 		return
 	}
+	defer func() {
+		if err != nil {
+			closeBackends(backends)
+		}
+	}()
 
-	measurementToBackends, err := ic.loadMeasurements(backends)
+	defaultRoutes, routes, err := ic.loadRoutes(backends)
 	if err != nil {
 		return
 	}
 
+	if ic.deadLetters == nil {
+		var path string
+		path, err = dataPath(ic.config.Proxy.DataDir, ProxyDeadLetters)
+		if err == nil {
+			err = migrateData(ProxyDeadLetters, path)
+		}
+		if err != nil {
+			return
+		}
+		ic.deadLetters, err = NewDeadLetterFile(path, ic.config.Proxy.DeadLetterMaxSize)
+		if err != nil {
+			return
+		}
+	}
+
 	ic.lock.Lock()
-	originBackends := ic.backends
+	ic.policy = policy
+	ic.users = users
 	ic.backends = backends
-	ic.measurementToBackends = measurementToBackends
+	ic.defaultRoutes = defaultRoutes
+	ic.routes = routes
 	ic.lock.Unlock()
-	// Close origin backends
-	for name, bs := range originBackends {
-		err = bs.Close()
+	return
+}
+
+// closeBackends closes the backends and waits for them to shut down.
+func closeBackends(backends map[string]BackendApi) {
+	for name, bs := range backends {
+		err := bs.Close()
 		if err != nil {
 			log.Printf("Fail in close backend %s", name)
 		}
 	}
+}
+
+// Reload reads the configuration file again, then inits with it. The proxy
+// settings read once at start keep their values until a restart. If the
+// new configuration can't be loaded, the previous one is loaded again.
+func (ic *InfluxCluster) Reload() (err error) {
+	if ic.config.filename == "" {
+		return ic.Init()
+	}
+	cfg, err := ReadConfigFile(ic.config.filename)
+	if err != nil {
+		log.Printf("reload config error: %s", err)
+		return
+	}
+	ic.lock.Lock()
+	origin := ic.config
+	ic.config = cfg
+	ic.lock.Unlock()
+	if changed := restartSettings(&origin.Proxy, &cfg.Proxy); len(changed) > 0 {
+		log.Printf("reload config: restart to apply %s", strings.Join(changed, ", "))
+	}
+
+	err = ic.Init()
+	if err != nil {
+		log.Printf("reload config error: %s, back to the previous one", err)
+		ic.lock.Lock()
+		ic.config = origin
+		ic.lock.Unlock()
+		if ierr := ic.Init(); ierr != nil {
+			log.Printf("init previous config error: %s", ierr)
+		}
+	}
 	return
 }
 
-func (ic *InfluxCluster) Ping() (version string, err error) {
-	atomic.AddInt64(&ic.stats.PingRequests, 1)
-	version = VERSION
+// restartSettings names the proxy settings changed from a to b which only
+// apply at start.
+func restartSettings(a, b *ProxyConfig) (changed []string) {
+	settings := []struct {
+		name string
+		same bool
+	}{
+		{"listenAddr", a.ListenAddr == b.ListenAddr},
+		{"zone", a.Zone == b.Zone},
+		{"interval", a.Interval == b.Interval},
+		{"idleTimeout", a.IdleTimeout == b.IdleTimeout},
+		{"writeTracing", a.WriteTracing == b.WriteTracing},
+		{"queryTracing", a.QueryTracing == b.QueryTracing},
+		{"syncWrite", a.SyncWrite == b.SyncWrite},
+		{"writeWorkers", a.WriteWorkers == b.WriteWorkers},
+		{"maxBodySize", a.MaxBodySize == b.MaxBodySize},
+		{"queryHedgeDelay", a.QueryHedgeDelay == b.QueryHedgeDelay},
+		{"queryRace", a.QueryRace == b.QueryRace},
+	}
+	for _, setting := range settings {
+		if !setting.same {
+			changed = append(changed, setting.name)
+		}
+	}
 	return
 }
 
-func (ic *InfluxCluster) CheckQuery(q string) (err error) {
+// proxyDB returns the database of the proxy configuration in use.
+func (ic *InfluxCluster) proxyDB() string {
 	ic.lock.RLock()
 	defer ic.lock.RUnlock()
+	return ic.config.Proxy.DB
+}
+
+// Authenticate returns the user of the request, nil if no users are
+// configured and so authentication is off.
+func (ic *InfluxCluster) Authenticate(req *http.Request) (user *User, err error) {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+
+	if len(ic.users) == 0 {
+		return
+	}
+	username, password, ok := GetCredentials(req)
+	if !ok {
+		return nil, ErrAuthRequired
+	}
+	user, ok = ic.users[username]
+	if !ok || !user.CheckPassword(password) {
+		return nil, ErrAuthFailed
+	}
+	return
+}
 
-	if len(ic.ForbiddenQuery) != 0 {
-		for _, fq := range ic.ForbiddenQuery {
-			if fq.MatchString(q) {
-				return ErrQueryForbidden
+// authorizeStatement checks the user's permission on every measurement the
+// statement reads, deletes from or writes into.
+func (ic *InfluxCluster) authorizeStatement(user *User, stmt influxql.Statement, rt *routeTable) (err error) {
+	if user == nil {
+		return
+	}
+	perm := PermRead
+	switch stmt.(type) {
+	case *influxql.DeleteStatement, *influxql.DeleteSeriesStatement, *influxql.DropSeriesStatement, *influxql.DropMeasurementStatement:
+		perm = PermDelete
+	}
+
+	// a statement naming no measurement may touch any of them.
+	measurements := measurementsOfStatement(stmt)
+	if len(measurements) == 0 && !user.CanAll(perm) {
+		return ErrPermissionDenied
+	}
+	for _, m := range measurements {
+		if m.Regex != nil {
+			if !user.CanAll(perm) {
+				return ErrPermissionDenied
 			}
+			continue
+		}
+		if !user.Can(perm, m.Name, rt.keymapOf(m.Name)) {
+			return ErrPermissionDenied
 		}
 	}
 
-	if len(ic.ObligatedQuery) != 0 {
-		for _, pq := range ic.ObligatedQuery {
-			if pq.MatchString(q) {
-				return
-			}
+	if s, ok := stmt.(*influxql.SelectStatement); ok && s.Target != nil && s.Target.Measurement != nil {
+		name := s.Target.Measurement.Name
+		if !user.Can(PermWrite, name, rt.keymapOf(name)) {
+			return ErrPermissionDenied
 		}
-		return ErrQueryForbidden
 	}
+	return
+}
 
+func (ic *InfluxCluster) Ping() (version string, err error) {
+	atomic.AddInt64(&ic.stats.PingRequests, 1)
+	version = VERSION
 	return
 }
 
-func (ic *InfluxCluster) GetBackends(key string) (backends []BackendApi, ok bool) {
+func (ic *InfluxCluster) CheckQuery(stmt influxql.Statement) (err error) {
 	ic.lock.RLock()
 	defer ic.lock.RUnlock()
 
-	backends, ok = ic.measurementToBackends[key]
+	if ic.policy == nil {
+		return
+	}
+	return ic.policy.Check(stmt)
+}
+
+// getRoutes returns the routing table of db. The top-level keymaps route
+// the proxy database, and any database when the proxy isn't given one.
+func (ic *InfluxCluster) getRoutes(db string) (rt *routeTable, ok bool) {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+
+	rt, ok = ic.routes[db]
+	if ok {
+		return
+	}
+	if db == "" || ic.config.Proxy.DB == "" {
+		return ic.defaultRoutes, ic.defaultRoutes != nil
+	}
+	return nil, false
+}
+
+// GetBackends looks up key in the top-level routing table.
+func (ic *InfluxCluster) GetBackends(key string) (backends []BackendApi, ok bool) {
+	rt, ok := ic.getRoutes("")
+	if !ok {
+		return
+	}
+	return rt.GetBackends(key)
+}
+
+func (ic *InfluxCluster) GetShard(key string) (shard *shardRoute, ok bool) {
+	rt, ok := ic.getRoutes("")
 	if !ok {
-		backends, ok = ic.measurementToBackends["_default_"]
+		return
 	}
+	return rt.GetShard(key)
+}
+
+func (ic *InfluxCluster) GetRoute(key string) (route *RouteMetadata) {
+	rt, ok := ic.getRoutes("")
+	if !ok {
+		return &RouteMetadata{Measurement: key, Backends: []string{}}
+	}
+	return rt.GetRoute(key)
+}
+
+// databases returns the databases with a routing table, or those of the
+// backends if the proxy serves any.
+func (ic *InfluxCluster) databases() (dbs []string) {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+
+	for db := range ic.routes {
+		dbs = append(dbs, db)
+	}
+	if len(dbs) == 0 {
+		distinct := make(map[string]bool)
+		for _, cfg := range ic.config.Backends {
+			if cfg.DB != "" && !distinct[cfg.DB] {
+				distinct[cfg.DB] = true
+				dbs = append(dbs, cfg.DB)
+			}
+		}
+	}
+	sort.Strings(dbs)
 	return
 }
 
@@ -341,145 +568,520 @@ func (ic *InfluxCluster) Query(w http.ResponseWriter, req *http.Request) (err er
 		return
 	}
 
-	err = ic.CheckQuery(q)
+	user, err := ic.Authenticate(req)
 	if err != nil {
-		w.WriteHeader(400)
-		_, _ = w.Write([]byte("query forbidden"))
+		_ = WriteResponse(w, 401, &Response{Err: err.Error()})
 		atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
 		return
 	}
+	StripCredentials(req)
 
-	measurements, err := GetMeasurementsFromInfluxQL(q)
+	db := req.FormValue("db")
+	if db == "" {
+		db = ic.proxyDB()
+		if db != "" {
+			req.Form.Set("db", db)
+		}
+	}
+	rt, ok := ic.getRoutes(db)
+	if !ok {
+		_ = WriteResponse(w, 404, &Response{Err: ErrDatabaseNotFound.Error() + ": " + db})
+		atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
+		return ErrDatabaseNotFound
+	}
+
+	query, err := influxql.ParseQuery(q)
+	switch {
+	case err == nil && len(query.Statements) > 1:
+		err = ic.queryStatements(w, req, query.Statements, user, rt)
+	case err == nil && len(query.Statements) == 1:
+		err = ic.queryStatement(w, req, query.Statements[0].String(), user, rt)
+	default:
+		err = ic.queryStatement(w, req, q, user, rt)
+	}
 	if err != nil {
-		log.Printf("can't get measurement: %s\n", q)
+		atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
+	}
+	return
+}
+
+// queryStatements runs a batch statement by statement, each on its own
+// backends, and stitches the results back together. Like InfluxDB, the
+// statements after a failed one are not executed.
+func (ic *InfluxCluster) queryStatements(w http.ResponseWriter, req *http.Request, stmts influxql.Statements, user *User, rt *routeTable) (err error) {
+	resp := &Response{}
+	for i, stmt := range stmts {
+		result := &Result{StatementID: i}
+		resp.Results = append(resp.Results, result)
+		if err != nil {
+			result.Err = "not executed"
+			continue
+		}
+
+		buf := newResponseBuffer()
+		r := cloneQueryRequest(req)
+		r.Form.Set("q", stmt.String())
+		err = ic.queryStatement(buf, r, stmt.String(), user, rt)
+		if err == ErrQueryTimeout {
+			result.Err = err.Error()
+			continue
+		}
+		if err != nil {
+			result.Err = strings.TrimSpace(buf.buffer.String())
+			continue
+		}
+
+		sub, decodeErr := DecodeResponse(&buf.buffer)
+		if decodeErr != nil {
+			log.Printf("decode response error: %s\n", decodeErr)
+			result.Err = decodeErr.Error()
+			continue
+		}
+		for _, subResult := range sub.Results {
+			MergeResult(result, subResult)
+		}
+		if sub.Err != "" && result.Err == "" {
+			result.Err = sub.Err
+		}
+	}
+
+	failed := err
+	err = writeMerged(w, req, resp)
+	if err == nil {
+		err = failed
+	}
+	return
+}
+
+// queryStatement checks a single statement and sends it to its backends in
+// the routing table rt.
+func (ic *InfluxCluster) queryStatement(w http.ResponseWriter, req *http.Request, q string, user *User, rt *routeTable) (err error) {
+	stmt, err := influxql.ParseStatement(q)
+	if err != nil {
+		log.Printf("can't parse query: %s\n", q)
 		w.WriteHeader(400)
 		_, _ = w.Write([]byte("can't get measurement or influxql is invalid"))
-		atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
 		return
 	}
-	if len(measurements) > 1 {
-		log.Printf("don't support multiple measurements: %s\n", q)
+
+	err = ic.CheckQuery(stmt)
+	if err != nil {
 		w.WriteHeader(400)
-		_, _ = w.Write([]byte("don't support multiple measurements"))
-		atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
+		_, _ = w.Write([]byte("query forbidden: " + err.Error()))
+		return
+	}
+
+	err = ic.authorizeStatement(user, stmt, rt)
+	if err != nil {
+		w.WriteHeader(403)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+
+	if IsDatabaseStatement(stmt) {
+		return ic.queryDatabase(w, req, stmt, rt)
+	}
+	sources, ok := GetSourcesFromStatement(stmt)
+	if ok && IsMultiSource(sources) {
+		return ic.querySources(w, req, stmt, sources, rt)
+	}
+
+	measurements, err := GetMeasurementsFromInfluxQL(q)
+	if err == nil && len(measurements) == 0 {
+		err = ErrIllegalQL
+	}
+	if err != nil {
+		log.Printf("can't get measurement: %s\n", q)
+		w.WriteHeader(400)
+		_, _ = w.Write([]byte("can't get measurement or influxql is invalid"))
 		return
 	}
 
-	apis, ok := ic.GetBackends(measurements[0])
+	if shard, ok := rt.GetShard(measurements[0]); ok {
+		return ic.queryShard(w, req, q, measurements[0], shard)
+	}
+
+	apis, ok := rt.GetBackends(measurements[0])
 	if !ok {
 		log.Printf("unknown measurement: %s,the query is %s\n", measurements, q)
 		w.WriteHeader(400)
 		_, _ = w.Write([]byte("unknown measurement"))
-		atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
+		return ErrUnknownMeasurement
+	}
+
+	err = ic.queryReplicas(w, req, apis)
+	if err == nil || err == ErrResponseInterrupted {
 		return
 	}
 
-	// same zone first, other zone. pass non-active.
-	// TODO: better way?
+	writeQueryError(w, err)
+	return
+}
 
-	for _, api := range apis {
-		if api.GetZone() != ic.zone {
-			continue
-		}
-		if !api.IsActive() || api.IsWriteOnly() {
-			continue
-		}
-		err = api.Query(w, req)
-		if err == nil {
-			return
-		}
+// queryShard sends the query to the shard pinned by the WHERE clause, or
+// else fans it out to every backend of the measurement and merges.
+func (ic *InfluxCluster) queryShard(w http.ResponseWriter, req *http.Request, q string, measurement string, shard *shardRoute) (err error) {
+	cond, err := GetConditionFromInfluxQL(q)
+	if err != nil {
+		w.WriteHeader(400)
+		_, _ = w.Write([]byte("can't get measurement or influxql is invalid"))
+		return
 	}
 
-	for _, api := range apis {
-		if api.GetZone() == ic.zone {
-			continue
+	tags, pinned := PinnedTags(cond, shard.rule.Tags)
+	if pinned {
+		err = ic.queryReplicas(w, req, shard.GetBackends(measurement, tags))
+		if err != nil && err != ErrResponseInterrupted {
+			writeQueryError(w, err)
 		}
-		if !api.IsActive() {
-			continue
-		}
-		err = api.Query(w, req)
-		if err == nil {
-			return
+		return
+	}
+
+	stmt, err := influxql.ParseStatement(q)
+	if err != nil || !MergeableAcrossShards(stmt, shard.rule.Tags) {
+		err = ErrUnmergeableShards
+		w.WriteHeader(400)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+
+	// every point lives on replication backends, so the answer is complete
+	// as long as fewer backends than that fail.
+	var groups [][]BackendApi
+	for _, api := range shard.AllBackends() {
+		groups = append(groups, []BackendApi{api})
+	}
+	var queries []string
+	added := selectShardTags(stmt, shard.rule.Tags)
+	if len(added) > 0 {
+		queries = make([]string, len(groups))
+		for i := range groups {
+			queries[i] = stmt.String()
 		}
 	}
+	bufs, errs := ic.queryFanOut(req, groups, queries)
+	resp, err := mergeFanOut(w, bufs, errs, shard.rule.Replication-1)
+	if err != nil {
+		return
+	}
+	resp.DropColumns(added)
+	orderMerged(stmt, resp)
+	return writeMerged(w, req, resp)
+}
 
-	w.WriteHeader(400)
-	_, _ = w.Write([]byte("query error"))
-	atomic.AddInt64(&ic.stats.QueryRequestsFail, 1)
-	return
+// WriteOptions carries the parameters of one write request.
+type WriteOptions struct {
+	User        *User  // nil for the proxy itself
+	DB          string // empty for the proxy database
+	RP          string
+	Precision   string // of the timestamps, kept as they are
+	Consistency string
+	Sync        bool // wait until the lines are accepted
+
+	routes *routeTable
+}
+
+// BatchKey is what the backends batch the lines of these options by.
+func (opts *WriteOptions) BatchKey() (key BatchKey, err error) {
+	return NewBatchKey(opts.DB, opts.RP, opts.Precision, opts.Consistency)
 }
 
 // Wrong in one row will not stop others.
-// So don't try to return error, just print it.
-func (ic *InfluxCluster) WriteRow(line []byte) {
-	atomic.AddInt64(&ic.stats.PointsWritten, 1)
-	// maybe trim?
-	line = bytes.TrimRight(line, " \t\r\n")
+// So don't try to stop on error, just print it and tell the caller.
+func (ic *InfluxCluster) WriteRow(line []byte, opts *WriteOptions) (err error) {
+	line, bs, err := ic.routeRow(line, opts)
+	if err != nil || line == nil {
+		return
+	}
 
-	// empty line, ignore it.
-	if len(line) == 0 {
+	batchKey, err := opts.BatchKey()
+	if err != nil {
+		atomic.AddInt64(&ic.stats.PointsWrittenFail, 1)
 		return
 	}
 
-	key, err := ScanKey(line)
+	// writes don't block, a backend behind spills or refuses the line.
+	// the other replicas get it whatever one of them says.
+	for _, b := range bs {
+		werr := b.WriteKey(line, batchKey)
+		if werr != nil {
+			log.Printf("cluster write fail: %s\n", line)
+			atomic.AddInt64(&ic.stats.PointsWrittenFail, 1)
+			err = werr
+		}
+	}
+	return
+}
+
+// routeRow parses a line and finds the backends it goes to. An empty line
+// gives a nil line and no error.
+func (ic *InfluxCluster) routeRow(line []byte, opts *WriteOptions) (row []byte, bs []BackendApi, err error) {
+	atomic.AddInt64(&ic.stats.PointsWritten, 1)
+	pt, err := ParsePoint(line)
 	if err != nil {
-		log.Printf("scan key error: %s\n", err)
+		log.Printf("parse line error: %s\n", err)
 		atomic.AddInt64(&ic.stats.PointsWrittenFail, 1)
 		return
 	}
 
-	bs, ok := ic.GetBackends(key)
+	// empty line or comment, ignore it.
+	if pt == nil {
+		return
+	}
+
+	rt := opts.routes
+	if rt == nil {
+		var ok bool
+		rt, ok = ic.getRoutes(opts.DB)
+		if !ok {
+			atomic.AddInt64(&ic.stats.PointsWrittenFail, 1)
+			return nil, nil, ErrDatabaseNotFound
+		}
+	}
+
+	key := pt.Measurement
+	var ok bool
+	if shard, sharded := rt.GetShard(key); sharded {
+		bs, ok = shard.GetBackends(key, pt.TagMap()), true
+	} else {
+		bs, ok = rt.GetBackends(key)
+	}
 	if !ok {
 		log.Printf("new measurement: %s\n", key)
 		atomic.AddInt64(&ic.stats.PointsWrittenFail, 1)
 		// TODO: new measurement?
-		return
+		return nil, nil, ErrUnknownMeasurement
 	}
 
-	// don't block here for a long time, we just have one worker.
-	for _, b := range bs {
-		err = b.Write(line)
-		if err != nil {
-			log.Printf("cluster write fail: %s\n", key)
-			atomic.AddInt64(&ic.stats.PointsWrittenFail, 1)
+	if opts.User != nil && !opts.User.Can(PermWrite, key, rt.keymapOf(key)) {
+		log.Printf("user %s can't write measurement: %s\n", opts.User.Name, key)
+		atomic.AddInt64(&ic.stats.PointsWrittenFail, 1)
+		return nil, nil, ErrPermissionDenied
+	}
+	return pt.Line, bs, nil
+}
+
+func (ic *InfluxCluster) Write(p []byte) (err error) {
+	return ic.WriteWith(p, &WriteOptions{})
+}
+
+// writeChunk is what the lines of a chunk of a write came to.
+type writeChunk struct {
+	group      *writeGroup
+	lineErrors []*LineError
+	letters    []*DeadLetter
+	last       int // number of the last line
+	written    int
+	denied     bool
+}
+
+// parseChunk parses and routes the lines of a chunk of a write, numbered
+// from first.
+func (ic *InfluxCluster) parseChunk(p []byte, first int, o *WriteOptions) (c *writeChunk) {
+	c = &writeChunk{group: newWriteGroup(), last: first - 1}
+	batchKey, _ := o.BatchKey()
+	buf := bytes.NewBuffer(p)
+	for {
+		// a bytes.Buffer fails only at the end.
+		line, _ := buf.ReadBytes('\n')
+		if len(line) == 0 {
 			return
 		}
+		c.last++
+		raw := bytes.TrimSpace(line)
+
+		line, bs, err := ic.routeRow(line, o)
+		switch err.(type) {
+		case nil:
+			if line != nil {
+				c.group.add(c.last, line, bs)
+				c.written++
+			}
+		case *ParseError:
+			// rejected at the edge, even by an asynchronous write.
+			c.lineErrors = append(c.lineErrors, &LineError{Line: c.last, Err: err})
+			c.letters = append(c.letters, NewDeadLetter(batchKey, raw, err))
+		default:
+			if err == ErrUnknownMeasurement {
+				c.letters = append(c.letters, NewDeadLetter(batchKey, raw, err))
+			}
+			if err == ErrPermissionDenied {
+				c.denied = true
+			} else if o.Sync {
+				c.lineErrors = append(c.lineErrors, &LineError{Line: c.last, Err: err})
+			}
+		}
 	}
-	return
 }
 
-func (ic *InfluxCluster) Write(p []byte) (err error) {
+// WriteWith writes the lines of p, as WriteStream does.
+func (ic *InfluxCluster) WriteWith(p []byte, opts *WriteOptions) (err error) {
+	return ic.WriteStream(bytes.NewReader(p), opts)
+}
+
+// writeState sums up the pieces of a streamed write.
+type writeState struct {
+	lineErrors []*LineError
+	failed     map[int]error
+	lineno     int
+	written    int
+	denied     bool
+}
+
+// WriteStream writes every line it can, routing them a piece at a time as
+// they are read from r, and returns ErrPermissionDenied if the user wasn't
+// allowed to write some of them, ErrOverloaded if some backend refused
+// lines to shed load, or else a *WriteError for the lines which couldn't
+// be parsed. A synchronous write waits until the lines are accepted, and
+// the *WriteError also holds those which couldn't be routed or accepted.
+// If reading r fails, the error is returned, and only the whole pieces
+// read before are written, not the one cut off.
+func (ic *InfluxCluster) WriteStream(r io.Reader, opts *WriteOptions) (err error) {
 	atomic.AddInt64(&ic.stats.WriteRequests, 1)
 	defer func(start time.Time) {
 		atomic.AddInt64(&ic.stats.WriteRequestDuration, time.Since(start).Nanoseconds())
 	}(time.Now())
 
-	buf := bytes.NewBuffer(p)
+	o := *opts
+	if o.DB == "" {
+		o.DB = ic.proxyDB()
+	}
+	rt, ok := ic.getRoutes(o.DB)
+	if !ok {
+		atomic.AddInt64(&ic.stats.WriteRequestsFail, 1)
+		return ErrDatabaseNotFound
+	}
+	o.routes = rt
 
-	var line []byte
-	for {
-		line, err = buf.ReadBytes('\n')
-		switch err {
-		default:
-			log.Printf("error: %s\n", err)
+	// refuse the whole request, as InfluxDB does, rather than every line.
+	batchKey, err := o.BatchKey()
+	if err != nil {
+		atomic.AddInt64(&ic.stats.WriteRequestsFail, 1)
+		return
+	}
+
+	ws := &writeState{failed: make(map[int]error)}
+	br := bufio.NewReaderSize(r, 64*1024)
+	var piece []byte
+	var rerr error
+	for rerr == nil {
+		var line []byte
+		line, rerr = br.ReadSlice('\n')
+		piece = append(piece, line...)
+		if rerr == bufio.ErrBufferFull {
+			// a long line.
+			rerr = nil
+			continue
+		}
+		if rerr != nil && rerr != io.EOF {
+			// the piece may end amid a line, drop it.
+			break
+		}
+		if rerr == nil && len(piece) < writePieceSize {
+			continue
+		}
+		if len(piece) > 0 {
+			ic.writePiece(piece, &o, batchKey, ws)
+			piece = piece[:0]
+		}
+	}
+	if rerr != io.EOF {
+		log.Printf("read body error: %s\n", rerr)
+		atomic.AddInt64(&ic.stats.WriteRequestsFail, 1)
+		return rerr
+	}
+
+	if ws.denied {
+		atomic.AddInt64(&ic.stats.WriteRequestsFail, 1)
+		return ErrPermissionDenied
+	}
+	for _, e := range ws.failed {
+		if e == ErrOverloaded {
 			atomic.AddInt64(&ic.stats.WriteRequestsFail, 1)
-			return
-		case io.EOF, nil:
-			err = nil
+			return ErrOverloaded
 		}
+	}
+	failed := ws.failed
+	if !o.Sync {
+		// nobody waits for these, as if spilled.
+		for _, e := range failed {
+			log.Printf("cluster write fail: %s\n", e)
+		}
+		atomic.AddInt64(&ic.stats.PointsWrittenFail, int64(len(failed)))
+		failed = nil
+	}
 
-		if len(line) == 0 {
-			break
+	werr := &WriteError{Lines: ws.lineErrors}
+	written := ws.written
+	for n := 1; n <= ws.lineno; n++ {
+		if e, ok := failed[n]; ok {
+			werr.Lines = append(werr.Lines, &LineError{Line: n, Err: e})
+			werr.Unavailable = true
+			written--
 		}
+	}
+	if len(werr.Lines) == 0 {
+		return
+	}
+	sort.Slice(werr.Lines, func(i, j int) bool {
+		return werr.Lines[i].Line < werr.Lines[j].Line
+	})
+	werr.Dropped = len(werr.Lines)
+	werr.Partial = written > 0
+	atomic.AddInt64(&ic.stats.WriteRequestsFail, 1)
+	return werr
+}
 
-		ic.WriteRow(line)
+// writePiece parses a piece of whole lines of a write in chunks at once,
+// then hands each backend its lines in one go.
+func (ic *InfluxCluster) writePiece(p []byte, o *WriteOptions, batchKey BatchKey, ws *writeState) {
+	chunks, first := splitLines(p, ic.WriteWorkers)
+	parsed := make([]*writeChunk, len(chunks))
+	var wg sync.WaitGroup
+	for i := range chunks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			parsed[i] = ic.parseChunk(chunks[i], ws.lineno+first[i], o)
+		}(i)
+	}
+	wg.Wait()
+
+	group := newWriteGroup()
+	var letters []*DeadLetter
+	for _, c := range parsed {
+		group.merge(c.group)
+		ws.lineErrors = append(ws.lineErrors, c.lineErrors...)
+		letters = append(letters, c.letters...)
+		ws.written += c.written
+		ws.denied = ws.denied || c.denied
+	}
+	if len(parsed) > 0 {
+		ws.lineno = parsed[len(parsed)-1].last
+	}
+	ic.deadLetter(letters)
+	for lineno, e := range group.flush(batchKey, o.Sync) {
+		ws.failed[lineno] = e
+	}
+}
+
+// deadLetter keeps the lines refused by the proxy to be replayed later.
+func (ic *InfluxCluster) deadLetter(letters []*DeadLetter) {
+	if len(letters) == 0 || ic.deadLetters == nil {
+		return
+	}
+	err := ic.deadLetters.Write(letters...)
+	if err != nil {
+		log.Printf("dead letter error: %s\n", err)
 	}
-	return
 }
 
 func (ic *InfluxCluster) Close() (err error) {
 	ic.lock.RLock()
 	defer ic.lock.RUnlock()
+	if ic.deadLetters != nil {
+		ic.deadLetters.Close()
+	}
 	for name, bs := range ic.backends {
 		err = bs.Close()
 		if err != nil {
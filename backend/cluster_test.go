@@ -6,12 +6,21 @@ package backend
 
 import (
 	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/influxdata/influxql"
 )
 
 func TestScanKey(t *testing.T) {
@@ -76,16 +85,16 @@ func BenchmarkScanKey(b *testing.B) {
 	}
 }
 
-func CreateTestInfluxCluster() (ic *InfluxCluster, err error) {
-	config := &Config{}
+func CreateTestInfluxCluster(t *testing.T) (ic *InfluxCluster, err error) {
+	config := &Config{Proxy: ProxyConfig{DataDir: t.TempDir()}}
 	ic = NewInfluxCluster(config)
 	backends := make(map[string]BackendApi)
 	bkcfgs := make(map[string]*BackendConfig)
-	cfg, _ := CreateTestBackendConfig("test1")
+	cfg, _ := CreateTestBackendConfig(t, "test1")
 	bkcfgs["test1"] = cfg
-	cfg, _ = CreateTestBackendConfig("test2")
+	cfg, _ = CreateTestBackendConfig(t, "test2")
 	bkcfgs["test2"] = cfg
-	cfg, _ = CreateTestBackendConfig("write_only")
+	cfg, _ = CreateTestBackendConfig(t, "write_only")
 	cfg.WriteOnly = 1
 	bkcfgs["write_only"] = cfg
 	for name, cfg := range bkcfgs {
@@ -98,13 +107,13 @@ func CreateTestInfluxCluster() (ic *InfluxCluster, err error) {
 	measurementToBackends := make(map[string][]BackendApi)
 	measurementToBackends["cpu"] = append(measurementToBackends["cpu"], backends["write_only"], backends["test1"])
 	measurementToBackends["write_only"] = append(measurementToBackends["write_only"], backends["write_only"])
-	ic.measurementToBackends = measurementToBackends
+	ic.defaultRoutes = &routeTable{measurementToBackends: measurementToBackends}
 
 	return
 }
 
 func TestInfluxdbClusterWrite(t *testing.T) {
-	ic, err := CreateTestInfluxCluster()
+	ic, err := CreateTestInfluxCluster(t)
 	if err != nil {
 		t.Error(err)
 		return
@@ -144,7 +153,7 @@ func TestInfluxdbClusterWrite(t *testing.T) {
 	time.Sleep(time.Second)
 }
 func TestInfluxdbClusterPing(t *testing.T) {
-	ic, err := CreateTestInfluxCluster()
+	ic, err := CreateTestInfluxCluster(t)
 	if err != nil {
 		t.Error(err)
 		return
@@ -162,7 +171,7 @@ func TestInfluxdbClusterPing(t *testing.T) {
 }
 
 func TestInfluxdbClusterQuery(t *testing.T) {
-	ic, err := CreateTestInfluxCluster()
+	ic, err := CreateTestInfluxCluster(t)
 	if err != nil {
 		t.Error(err)
 		return
@@ -215,7 +224,7 @@ func TestInfluxdbClusterQuery(t *testing.T) {
 		{
 			name:  "show_measurements",
 			query: "SHOW measurements ",
-			want:  400,
+			want:  200,
 		},
 		{
 			name:  "cpu.load2",
@@ -244,3 +253,870 @@ func TestInfluxdbClusterQuery(t *testing.T) {
 		}
 	}
 }
+
+func TestInfluxdbClusterQueryMultipleSources(t *testing.T) {
+	ic, err := CreateTestPatternCluster(t)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ic.Close()
+
+	tests := []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{
+			name:  "two_groups",
+			query: "SELECT * FROM \"app.db.latency\", \"app.cache.latency\" WHERE time > now() - 1m",
+			want:  200,
+		},
+		{
+			name:  "same_group",
+			query: "SELECT * FROM \"app.web.latency\", \"app.db.latency\" WHERE time > now() - 1m",
+			want:  204,
+		},
+		{
+			name:  "regex",
+			query: "SELECT * FROM /app\\..*/ WHERE time > now() - 1m",
+			want:  200,
+		},
+		{
+			name:  "subquery",
+			query: "SELECT mean(value) FROM (SELECT value FROM \"app.db.latency\") WHERE time > now() - 1m",
+			want:  204,
+		},
+		{
+			name:  "subquery_across_groups",
+			query: "SELECT mean(value) FROM (SELECT value FROM \"app.db.latency\", \"app.cache.latency\") WHERE time > now() - 1m",
+			want:  400,
+		},
+		{
+			name:  "show_tag_keys",
+			query: "SHOW TAG KEYS FROM \"app.db.latency\", \"app.cache.latency\"",
+			want:  200,
+		},
+	}
+
+	for _, tt := range tests {
+		w := NewDummyResponseWriter()
+		q := url.Values{}
+		q.Set("q", tt.query)
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+		_ = ic.Query(w, req)
+		if w.status != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.status, tt.want)
+		}
+	}
+}
+
+func TestInfluxdbClusterQueryBatch(t *testing.T) {
+	ic, err := CreateTestInfluxCluster(t)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		errors []string
+	}{
+		{
+			name:   "two_statements",
+			query:  "SELECT * FROM cpu WHERE time > now() - 1m; SELECT cpu_load FROM cpu WHERE time > now() - 1m",
+			errors: []string{"", ""},
+		},
+		{
+			name:   "failed_statement",
+			query:  "SELECT * FROM cpu; SELECT cpu_load FROM test; SELECT * FROM cpu",
+			errors: []string{"", "unknown measurement", "not executed"},
+		},
+		{
+			name:   "forbidden_statement",
+			query:  "SELECT * FROM cpu; DROP MEASUREMENT cpu",
+			errors: []string{"", "query forbidden: statement forbidden"},
+		},
+	}
+
+	for _, tt := range tests {
+		w := NewDummyResponseWriter()
+		q := url.Values{}
+		q.Set("q", tt.query)
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+		_ = ic.Query(w, req)
+		if w.status != 200 {
+			t.Errorf("%s: status %d", tt.name, w.status)
+			continue
+		}
+		resp, err := DecodeResponse(&w.buffer)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if len(resp.Results) != len(tt.errors) {
+			t.Errorf("%s: %d results, want %d", tt.name, len(resp.Results), len(tt.errors))
+			continue
+		}
+		for i, result := range resp.Results {
+			if result.StatementID != i || result.Err != tt.errors[i] {
+				t.Errorf("%s: result %d is %d %q, want %q", tt.name, i, result.StatementID, result.Err, tt.errors[i])
+			}
+		}
+	}
+}
+
+func TestInfluxdbClusterQueryDatabase(t *testing.T) {
+	ic, err := CreateTestPatternCluster(t)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ic.Close()
+	ic.config.Proxy.DB = "test"
+	err = ic.Init()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		want   string
+	}{
+		{
+			name:  "show_databases",
+			query: "SHOW DATABASES",
+			want:  `{"results":[{"statement_id":0,"series":[{"name":"databases","columns":["name"],"values":[["test"]]}]}]}`,
+		},
+		{
+			name:  "show_measurements",
+			query: "SHOW MEASUREMENTS",
+			want:  `{"results":[{"statement_id":0}]}`,
+		},
+		{
+			name:  "show_tag_keys",
+			query: "SHOW TAG KEYS",
+			want:  `{"results":[{"statement_id":0}]}`,
+		},
+		{
+			name:   "show_retention_policies",
+			query:  "SHOW RETENTION POLICIES ON test",
+			status: 204,
+		},
+		{
+			name:  "show_retention_policies_unknown",
+			query: "SHOW RETENTION POLICIES ON other",
+			want:  `{"results":[{"statement_id":0,"error":"database not found: other"}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		w := NewDummyResponseWriter()
+		q := url.Values{}
+		q.Set("q", tt.query)
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+		_ = ic.Query(w, req)
+		status := tt.status
+		if status == 0 {
+			status = 200
+		}
+		if w.status != status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.status, status)
+			continue
+		}
+		if strings.TrimSpace(w.buffer.String()) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, w.buffer.String(), tt.want)
+		}
+	}
+}
+
+// CreateTestRecordingBackend records the parameters of the requests sent
+// to the backend.
+func CreateTestRecordingBackend(t *testing.T, requests chan<- url.Values) (cfg *BackendConfig, ts *httptest.Server) {
+	cfg, ts = CreateTestBackendConfig(t, "")
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/ping" {
+			requests <- req.URL.Query()
+		}
+		HandlerAny(w, req)
+	})
+	return
+}
+
+func TestInfluxdbClusterDatabases(t *testing.T) {
+	requests1 := make(chan url.Values, 8)
+	requests2 := make(chan url.Values, 8)
+	cfg1, ts1 := CreateTestRecordingBackend(t, requests1)
+	defer ts1.Close()
+	cfg2, ts2 := CreateTestRecordingBackend(t, requests2)
+	defer ts2.Close()
+	config := &Config{
+		Proxy:    ProxyConfig{DB: "db1", DataDir: t.TempDir()},
+		Backends: map[string]BackendConfig{"b1": *cfg1, "b2": *cfg2},
+		Keymaps:  map[string][]string{"cpu": {"b1"}},
+		Databases: map[string]DatabaseConfig{
+			"db2": {Keymaps: map[string][]string{"cpu": {"b2"}}},
+		},
+	}
+	ic := NewInfluxCluster(config)
+	err := ic.Init()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer ic.Close()
+
+	query := func(db string) int {
+		w := NewDummyResponseWriter()
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query?db="+db+"&q=SELECT+*+FROM+cpu", nil)
+		_ = ic.Query(w, req)
+		return w.status
+	}
+	if status := query("db2"); status != 204 {
+		t.Errorf("query db2: status %d", status)
+	}
+	if q := <-requests2; q.Get("db") != "db2" {
+		t.Errorf("query db2 sent to db %s", q.Get("db"))
+	}
+	if status := query(""); status != 204 {
+		t.Errorf("query default: status %d", status)
+	}
+	if q := <-requests1; q.Get("db") != "db1" {
+		t.Errorf("query default sent to db %s", q.Get("db"))
+	}
+	if status := query("db3"); status != 404 {
+		t.Errorf("query db3: status %d, want 404", status)
+	}
+
+	err = ic.WriteWith([]byte("cpu value=1 1434055562\n"), &WriteOptions{DB: "db2", RP: "week", Precision: "s"})
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	select {
+	case q := <-requests2:
+		if q.Get("db") != "db2" || q.Get("rp") != "week" || q.Get("precision") != "s" {
+			t.Errorf("write sent with %v", q)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("write not sent")
+	}
+	err = ic.WriteWith([]byte("cpu value=1\n"), &WriteOptions{DB: "db3"})
+	if err != ErrDatabaseNotFound {
+		t.Errorf("write db3: got %v, want %v", err, ErrDatabaseNotFound)
+	}
+}
+
+func TestInfluxdbClusterShowRetentionPolicies(t *testing.T) {
+	requests := make(chan url.Values, 8)
+	cfg1, ts1 := CreateTestRecordingBackend(t, requests)
+	defer ts1.Close()
+	cfg2, ts2 := CreateTestRecordingBackend(t, requests)
+	defer ts2.Close()
+	config := &Config{
+		Proxy:    ProxyConfig{DB: "test", DataDir: t.TempDir()},
+		Backends: map[string]BackendConfig{"b1": *cfg1, "b2": *cfg2},
+		Keymaps:  map[string][]string{"cpu": {"b1"}, "mem": {"b2"}},
+	}
+	ic := NewInfluxCluster(config)
+	err := ic.Init()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer ic.Close()
+
+	w := NewDummyResponseWriter()
+	req, _ := http.NewRequest("GET", "http://localhost:8086/query?q=SHOW+RETENTION+POLICIES+ON+test", nil)
+	_ = ic.Query(w, req)
+	if q := <-requests; q.Get("q") != "SHOW RETENTION POLICIES" || q.Get("db") != "test" {
+		t.Errorf("sent %v", q)
+	}
+	select {
+	case q := <-requests:
+		t.Errorf("asked a second backend: %v", q)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestInfluxdbClusterShowLimit(t *testing.T) {
+	answer := func(names string) (cfg *BackendConfig, ts *httptest.Server) {
+		cfg, ts = CreateTestBackendConfig(t, "test")
+		ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != "/query" {
+				HandlerAny(w, req)
+				return
+			}
+			if q := req.FormValue("q"); q != "SHOW MEASUREMENTS LIMIT 3" {
+				t.Errorf("sent %s", q)
+			}
+			_, _ = w.Write([]byte(`{"results":[{"statement_id":0,"series":[{"name":"measurements","columns":["name"],"values":` + names + `}]}]}`))
+		})
+		return
+	}
+	cfg1, ts1 := answer(`[["cpu"],["disk"],["mem"]]`)
+	defer ts1.Close()
+	cfg2, ts2 := answer(`[["cpu"],["load"],["net"]]`)
+	defer ts2.Close()
+	config := &Config{
+		Proxy:    ProxyConfig{DB: "test", DataDir: t.TempDir()},
+		Backends: map[string]BackendConfig{"b1": *cfg1, "b2": *cfg2},
+		Keymaps:  map[string][]string{"cpu": {"b1"}, "mem": {"b2"}},
+	}
+	ic := NewInfluxCluster(config)
+	err := ic.Init()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer ic.Close()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost:8086/query?q=SHOW+MEASUREMENTS+LIMIT+2+OFFSET+1", nil)
+	_ = ic.Query(w, req)
+	want := `{"results":[{"statement_id":0,"series":[{"name":"measurements","columns":["name"],"values":[["disk"],["load"]]}]}]}`
+	if got := strings.TrimSpace(w.Body.String()); got != want {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestInfluxdbClusterSyncWrite(t *testing.T) {
+	requests := make(chan url.Values, 8)
+	cfg1, ts1 := CreateTestRecordingBackend(t, requests)
+	defer ts1.Close()
+	cfg2, ts2 := CreateTestBackendConfig(t, "test")
+	defer ts2.Close()
+	ts2.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/write" {
+			w.WriteHeader(400)
+			return
+		}
+		HandlerAny(w, req)
+	})
+	config := &Config{
+		Proxy:    ProxyConfig{DB: "test", DataDir: t.TempDir()},
+		Backends: map[string]BackendConfig{"good": *cfg1, "bad": *cfg2},
+		Keymaps:  map[string][]string{"cpu": {"good"}, "mem": {"bad"}},
+	}
+	ic := NewInfluxCluster(config)
+	err := ic.Init()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer ic.Close()
+
+	err = ic.WriteWith([]byte("cpu value=1\ncpu\ndisk value=1\n"), &WriteOptions{Sync: true})
+	werr, ok := err.(*WriteError)
+	if !ok {
+		t.Fatalf("want a write error, got %v", err)
+	}
+	want := "partial write: line 2: unable to parse 'cpu': missing fields; line 3: unknown measurement dropped=2"
+	if werr.Error() != want || werr.Unavailable {
+		t.Errorf("got %q, want %q", werr.Error(), want)
+	}
+	select {
+	case <-requests:
+	default:
+		t.Errorf("returned before the backend got the lines")
+	}
+
+	err = ic.WriteWith([]byte("mem value=1\n"), &WriteOptions{Sync: true})
+	werr, ok = err.(*WriteError)
+	if !ok || !werr.Unavailable || werr.Partial || werr.Dropped != 1 {
+		t.Errorf("want a failed write, got %v", err)
+	}
+
+	err = ic.WriteWith([]byte("cpu value=1\n"), &WriteOptions{Sync: true})
+	if err != nil {
+		t.Errorf("error: %s", err)
+	}
+
+	// unparsable lines are rejected by asynchronous writes too
+	err = ic.WriteWith([]byte("cpu value=1\ncpu value=\ndisk value=1\n"), &WriteOptions{})
+	werr, ok = err.(*WriteError)
+	if !ok || !werr.Partial || werr.Dropped != 1 || werr.Lines[0].Line != 2 {
+		t.Errorf("want a partial write, got %v", err)
+	}
+}
+
+func TestInfluxdbClusterSyncWriteRejected(t *testing.T) {
+	cfg, ts := CreateTestBackendConfig(t, "rejecting")
+	defer ts.Close()
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/write" {
+			HandlerAny(w, req)
+			return
+		}
+		zip, _ := gzip.NewReader(req.Body)
+		p, _ := ioutil.ReadAll(zip)
+		if bytes.Contains(p, []byte("bad")) {
+			w.WriteHeader(400)
+			_, _ = w.Write([]byte(`{"error":"field type conflict"}`))
+			return
+		}
+		w.WriteHeader(204)
+	})
+	config := &Config{
+		Proxy:    ProxyConfig{DB: "test", DataDir: t.TempDir()},
+		Backends: map[string]BackendConfig{"rejecting": *cfg},
+		Keymaps:  map[string][]string{"cpu": {"rejecting"}},
+	}
+	ic := NewInfluxCluster(config)
+	err := ic.Init()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer ic.Close()
+
+	// only the line refused is reported, the others were written.
+	err = ic.WriteWith([]byte("cpu value=1\ncpu,bad=1 value=2\ncpu value=3\ncpu value=4\n"), &WriteOptions{Sync: true})
+	werr, ok := err.(*WriteError)
+	if !ok {
+		t.Fatalf("want a write error, got %v", err)
+	}
+	if len(werr.Lines) != 1 || werr.Lines[0].Line != 2 || !werr.Partial || werr.Dropped != 1 {
+		t.Errorf("got %q", werr.Error())
+	}
+}
+
+func TestInfluxdbClusterDeadLetters(t *testing.T) {
+	requests := make(chan url.Values, 8)
+	cfg, ts := CreateTestRecordingBackend(t, requests)
+	defer ts.Close()
+	config := &Config{
+		Proxy:    ProxyConfig{DB: "test", DataDir: t.TempDir()},
+		Backends: map[string]BackendConfig{"good": *cfg},
+		Keymaps:  map[string][]string{"cpu": {"good"}},
+	}
+	ic := NewInfluxCluster(config)
+	err := ic.Init()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer ic.Close()
+
+	err = ic.WriteWith([]byte("cpu value=1\ndisk value=1\ndisk value=\n"), &WriteOptions{RP: "week", Sync: true})
+	if _, ok := err.(*WriteError); !ok {
+		t.Fatalf("want a write error, got %v", err)
+	}
+	<-requests
+
+	letters, err := ic.ListDeadLetters(ProxyDeadLetters, 1, 0)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if len(letters) != 1 || letters[0].Line != "disk value=" || letters[0].DB != "test" || letters[0].RP != "week" {
+		t.Errorf("dead letters: %+v", letters)
+	}
+
+	stats, err := ic.DeadLetterStats()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if len(stats) != 2 || stats[0].Name != ProxyDeadLetters || stats[0].Count != 2 || stats[1].Count != 0 {
+		t.Errorf("stats: %+v", stats)
+	}
+
+	_, err = ic.ListDeadLetters("nowhere", 0, 0)
+	if err != ErrDeadLettersNotFound {
+		t.Errorf("want not found, got %v", err)
+	}
+
+	// fix the keymap, the unknown measurement goes through this time.
+	ic.defaultRoutes.measurementToBackends["disk"] = ic.defaultRoutes.measurementToBackends["cpu"]
+	replayed, err := ic.ReplayDeadLetters(ProxyDeadLetters)
+	if err != nil || replayed != 2 {
+		t.Fatalf("replayed %d, error: %v", replayed, err)
+	}
+	select {
+	case values := <-requests:
+		if values.Get("rp") != "week" {
+			t.Errorf("replayed with %v", values)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("nothing replayed")
+	}
+
+	letters, err = ic.ListDeadLetters(ProxyDeadLetters, 0, 0)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if len(letters) != 1 || letters[0].Line != "disk value=" {
+		t.Errorf("dead letters after replay: %+v", letters)
+	}
+
+	err = ic.PurgeDeadLetters(ProxyDeadLetters)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	letters, _ = ic.ListDeadLetters(ProxyDeadLetters, 0, 0)
+	if len(letters) != 0 {
+		t.Errorf("dead letters after purge: %+v", letters)
+	}
+}
+
+func TestInfluxdbClusterReloadPolicy(t *testing.T) {
+	file, err := ioutil.TempFile("", "influx-proxy-*.json")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer os.Remove(file.Name())
+	_, _ = file.WriteString(`{"policy": {}}`)
+	_ = file.Close()
+
+	cfg, err := ReadConfigFile(file.Name())
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	cfg.Proxy.DataDir = t.TempDir()
+	ic := NewInfluxCluster(cfg)
+	err = ic.Init()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+
+	stmt, _ := influxql.ParseStatement("SELECT * FROM cpu")
+	if err = ic.CheckQuery(stmt); err != nil {
+		t.Errorf("select should pass: %s", err)
+	}
+
+	err = ioutil.WriteFile(file.Name(), []byte(`{"policy": {"denyStatements": ["select"]}}`), 0644)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	err = ic.Reload()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if err = ic.CheckQuery(stmt); err != ErrStatementForbidden {
+		t.Errorf("select should be denied after reload, got %v", err)
+	}
+}
+
+func TestInfluxdbClusterReloadDatabase(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "proxy.json")
+	config := func(db string) {
+		p := fmt.Sprintf(`{"proxy": {"db": %q, "dataDir": %q}}`, db, dir)
+		if err := ioutil.WriteFile(filename, []byte(p), 0644); err != nil {
+			t.Fatalf("error: %s", err)
+		}
+	}
+	config("a")
+	cfg, err := ReadConfigFile(filename)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	ic := NewInfluxCluster(cfg)
+	err = ic.Init()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer ic.Close()
+
+	// requests go on while the configuration changes.
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			req, _ := http.NewRequest("GET", "http://localhost:8086/query?q=SHOW+DATABASES", nil)
+			_ = ic.Query(NewDummyResponseWriter(), req)
+			_ = ic.WriteWith([]byte("cpu value=1\n"), &WriteOptions{})
+		}
+	}()
+	config("b")
+	err = ic.Reload()
+	close(stop)
+	<-done
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost:8086/query?q=SHOW+DATABASES", nil)
+	_ = ic.Query(w, req)
+	if got := strings.TrimSpace(w.Body.String()); !strings.Contains(got, `[["b"]]`) {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestInfluxdbClusterReloadBackends(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "proxy.json")
+	config := func(keymap string) {
+		p := fmt.Sprintf(`{"proxy": {"dataDir": %q},
+			"backends": {"down": {"url": "http://127.0.0.1:1", "db": "test", "interval": 10, "rewriteInterval": 60000}},
+			"keymaps": {"_default_": [%q]}}`, dir, keymap)
+		if err := ioutil.WriteFile(filename, []byte(p), 0644); err != nil {
+			t.Fatalf("error: %s", err)
+		}
+	}
+	config("down")
+	cfg, err := ReadConfigFile(filename)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	ic := NewInfluxCluster(cfg)
+	err = ic.Init()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer ic.Close()
+
+	// the line queued is spilled by the backend closed, for the new one.
+	err = ic.WriteWith([]byte("cpu value=1\n"), &WriteOptions{})
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	err = ic.Reload()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	bs := ic.backends["down"].(*Backend)
+	if !bs.fileBackend.IsData() {
+		t.Errorf("spilled line lost")
+	}
+
+	// a configuration which can't be loaded leaves the previous one.
+	config("unknown")
+	if err = ic.Reload(); err == nil {
+		t.Errorf("reloaded an unknown backend")
+	}
+	err = ic.WriteWith([]byte("cpu value=2\n"), &WriteOptions{})
+	if err != nil {
+		t.Errorf("error: %s", err)
+	}
+	if _, ok := ic.backends["down"]; !ok {
+		t.Errorf("backends %v", ic.backends)
+	}
+}
+
+// countingBackend records the writes handed to it.
+type countingBackend struct {
+	BackendApi
+	lock   sync.Mutex
+	writes [][]byte
+}
+
+func (cb *countingBackend) WriteKey(p []byte, key BatchKey) (err error) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	cb.writes = append(cb.writes, append([]byte(nil), p...))
+	return
+}
+
+func TestInfluxdbClusterWriteChunks(t *testing.T) {
+	ic := NewInfluxCluster(&Config{Proxy: ProxyConfig{WriteWorkers: 4, DataDir: t.TempDir()}})
+	b1, b2 := &countingBackend{}, &countingBackend{}
+	ic.defaultRoutes = &routeTable{measurementToBackends: map[string][]BackendApi{
+		"cpu": {b1, b2},
+		"mem": {b2},
+	}}
+
+	var buf bytes.Buffer
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&buf, "%s value=%d 1434055562000010000\n", []string{"cpu", "mem"}[i%2], i)
+	}
+	if chunks, _ := splitLines(buf.Bytes(), 4); len(chunks) < 2 {
+		t.Fatalf("got %d chunks, want the write parsed in several", len(chunks))
+	}
+	err := ic.Write(buf.Bytes())
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+
+	if len(b1.writes) != 1 || len(b2.writes) != 1 {
+		t.Fatalf("got %d and %d writes, want one a backend", len(b1.writes), len(b2.writes))
+	}
+	if n := bytes.Count(b1.writes[0], []byte{'\n'}); n != 5000 {
+		t.Errorf("got %d lines, want 5000", n)
+	}
+	// the lines keep their order.
+	lines := bytes.Split(bytes.TrimSpace(b2.writes[0]), []byte{'\n'})
+	if len(lines) != 10000 {
+		t.Fatalf("got %d lines, want 10000", len(lines))
+	}
+	for i, line := range lines {
+		if !bytes.Contains(line, []byte(fmt.Sprintf(" value=%d ", i))) {
+			t.Fatalf("line %d is %q", i, line)
+		}
+	}
+}
+
+func TestSplitLines(t *testing.T) {
+	p := bytes.Repeat([]byte("cpu value=1\n"), minWriteChunk)
+	chunks, first := splitLines(append(p, "mem value=2"...), 3)
+	if len(chunks) != 3 {
+		t.Fatalf("got %d chunks, want 3", len(chunks))
+	}
+	lineno := 1
+	for i, chunk := range chunks {
+		if first[i] != lineno {
+			t.Errorf("chunk %d starts at line %d, want %d", i, first[i], lineno)
+		}
+		if i < len(chunks)-1 && chunk[len(chunk)-1] != '\n' {
+			t.Errorf("chunk %d cuts a line", i)
+		}
+		lineno += bytes.Count(chunk, []byte{'\n'})
+	}
+	if !bytes.HasSuffix(chunks[2], []byte("mem value=2")) {
+		t.Errorf("last line lost")
+	}
+
+	chunks, _ = splitLines([]byte("cpu value=1\n"), 4)
+	if len(chunks) != 1 {
+		t.Errorf("got %d chunks of a small write, want 1", len(chunks))
+	}
+}
+
+// failingReader fails once its data is read.
+type failingReader struct {
+	r io.Reader
+}
+
+func (fr *failingReader) Read(p []byte) (n int, err error) {
+	n, err = fr.r.Read(p)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+func TestInfluxdbClusterWriteStream(t *testing.T) {
+	ic := NewInfluxCluster(&Config{Proxy: ProxyConfig{DataDir: t.TempDir()}})
+	b := &countingBackend{}
+	ic.defaultRoutes = &routeTable{measurementToBackends: map[string][]BackendApi{"cpu": {b}}}
+
+	// a line longer than the read buffer, and more than a piece.
+	long := "cpu " + strings.Repeat("f=1,", 32*1024) + "g=1\n"
+	body := strings.Repeat("cpu value=1\n", writePieceSize/12+1) + long
+	err := ic.WriteStream(strings.NewReader(body), &WriteOptions{})
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if len(b.writes) != 2 {
+		t.Errorf("got %d writes, want one a piece", len(b.writes))
+	}
+	if got := string(bytes.Join(b.writes, nil)); got != body {
+		t.Errorf("got %d bytes, want %d", len(got), len(body))
+	}
+
+	// the whole pieces read before a failure are written, not the one cut
+	// off amid a line.
+	b.writes = nil
+	piece := strings.Repeat("cpu value=1\n", writePieceSize/12+1)
+	err = ic.WriteStream(&failingReader{strings.NewReader(piece + "cpu value=1\ncpu value=12")}, &WriteOptions{})
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("want the read error, got %v", err)
+	}
+	if len(b.writes) != 1 || string(b.writes[0]) != piece {
+		t.Errorf("got %d writes, want the first piece", len(b.writes))
+	}
+
+	b.writes = nil
+	err = ic.WriteStream(&failingReader{strings.NewReader("cpu value=1\ncpu value=12")}, &WriteOptions{})
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("want the read error, got %v", err)
+	}
+	if len(b.writes) != 0 {
+		t.Errorf("got %q", b.writes)
+	}
+}
+
+func TestInfluxdbClusterQueryChunked(t *testing.T) {
+	// each backend answers in chunks of one row.
+	chunked := func(name string) (cfg *BackendConfig, ts *httptest.Server) {
+		cfg, ts = CreateTestBackendConfig(t, name)
+		ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != "/query" {
+				HandlerAny(w, req)
+				return
+			}
+			if req.FormValue("chunked") != "true" {
+				t.Errorf("%s: chunked query not passed on", name)
+			}
+			w.WriteHeader(200)
+			fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"name":"%s","columns":["time","value"],"values":[[1,1]],"partial":true}],"partial":true}]}`+"\n", name)
+			fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"name":"%s","columns":["time","value"],"values":[[2,2]]}]}]}`+"\n", name)
+		})
+		return
+	}
+	cfg1, ts1 := chunked("cpu")
+	defer ts1.Close()
+	cfg2, ts2 := chunked("mem")
+	defer ts2.Close()
+	config := &Config{
+		Proxy:    ProxyConfig{DataDir: t.TempDir()},
+		Backends: map[string]BackendConfig{"b1": *cfg1, "b2": *cfg2},
+		Keymaps:  map[string][]string{"cpu": {"b1"}, "mem": {"b2"}},
+	}
+	ic := NewInfluxCluster(config)
+	err := ic.Init()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer ic.Close()
+
+	q := url.Values{}
+	q.Set("q", "SELECT * FROM cpu, mem")
+	q.Set("chunked", "true")
+	q.Set("chunk_size", "3")
+	req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+q.Encode(), nil)
+	w := httptest.NewRecorder()
+	err = ic.Query(w, req)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+
+	chunks := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	want := []string{
+		`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[1,1],[2,2]]},{"name":"mem","columns":["time","value"],"values":[[1,1]],"partial":true}],"partial":true}]}`,
+		`{"results":[{"statement_id":0,"series":[{"name":"mem","columns":["time","value"],"values":[[2,2]]}]}]}`,
+	}
+	if len(chunks) != len(want) {
+		t.Fatalf("got %d chunks, want %d:\n%s", len(chunks), len(want), w.Body.String())
+	}
+	for i := range want {
+		if chunks[i] != want[i] {
+			t.Errorf("chunk %d:\n%s\nwant:\n%s", i, chunks[i], want[i])
+		}
+	}
+}
+
+func TestInfluxdbClusterQueryTimeout(t *testing.T) {
+	cfg, ts := CreateTestBackendConfig(t, "test")
+	defer ts.Close()
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/query" {
+			HandlerAny(w, req)
+			return
+		}
+		<-req.Context().Done()
+	})
+	cfg.TimeoutQuery = 20
+	config := &Config{
+		Proxy:    ProxyConfig{DataDir: t.TempDir()},
+		Backends: map[string]BackendConfig{"slow": *cfg},
+		Keymaps:  map[string][]string{"cpu": {"slow"}},
+	}
+	ic := NewInfluxCluster(config)
+	err := ic.Init()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer ic.Close()
+
+	req, _ := http.NewRequest("GET", "http://localhost:8086/query?q=select+*+from+cpu", nil)
+	w := httptest.NewRecorder()
+	err = ic.Query(w, req)
+	if err != ErrQueryTimeout {
+		t.Errorf("want a timeout, got %v", err)
+	}
+	if w.Code != 504 || strings.TrimSpace(w.Body.String()) != `{"error":"query timeout"}` {
+		t.Errorf("got %d %q", w.Code, w.Body.String())
+	}
+}
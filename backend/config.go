@@ -16,12 +16,76 @@ const (
 
 // Config Configuration file structure
 type Config struct {
-	Proxy    ProxyConfig              `json:"proxy"`
-	Backends map[string]BackendConfig `json:"backends"`
-	Keymaps  map[string][]string      `json:"keymaps"`
+	Proxy          ProxyConfig               `json:"proxy"`
+	Backends       map[string]BackendConfig  `json:"backends"`
+	Keymaps        map[string][]string       `json:"keymaps"`
+	PatternKeymaps []PatternKeymap           `json:"patternKeymaps"`
+	ShardKeymaps   map[string]ShardKeymap    `json:"shardKeymaps"`
+	Policy         PolicyConfig              `json:"policy"`
+	Users          map[string]UserConfig     `json:"users"`
+	Databases      map[string]DatabaseConfig `json:"databases"`
+
+	filename string
+}
+
+// DatabaseConfig Routing table of one more database, alike the top-level
+// one which routes the proxy database
+type DatabaseConfig struct {
+	Keymaps        map[string][]string    `json:"keymaps"`
+	PatternKeymaps []PatternKeymap        `json:"patternKeymaps"`
+	ShardKeymaps   map[string]ShardKeymap `json:"shardKeymaps"`
 }
 
-// ProxyConfig Proxy node configuration
+// DefaultDatabase is the routing table given at the top level.
+func (cfg *Config) DefaultDatabase() *DatabaseConfig {
+	return &DatabaseConfig{
+		Keymaps:        cfg.Keymaps,
+		PatternKeymaps: cfg.PatternKeymaps,
+		ShardKeymaps:   cfg.ShardKeymaps,
+	}
+}
+
+// PatternKeymap Measurement pattern rule, checked in order after exact keymaps
+type PatternKeymap struct {
+	Type     string   `json:"type"` // "regex" or "glob"
+	Pattern  string   `json:"pattern"`
+	Backends []string `json:"backends"`
+}
+
+// ShardKeymap Measurement spread over backends by a hash of measurement and tags
+type ShardKeymap struct {
+	Tags        []string `json:"tags"`
+	Backends    []string `json:"backends"`
+	Replication int      `json:"replication"`
+}
+
+// PolicyConfig Query policy, checked on the parsed statement
+type PolicyConfig struct {
+	AllowStatements    []string `json:"allowStatements"` // e.g. "select", "show_tag_keys"
+	DenyStatements     []string `json:"denyStatements"`
+	AllowMeasurements  []string `json:"allowMeasurements"` // globs
+	DenyMeasurements   []string `json:"denyMeasurements"`
+	AllowInto          []string `json:"allowInto"` // INTO targets, none by default
+	RequireTimeRange   bool     `json:"requireTimeRange"`
+	MaxTimeSpan        string   `json:"maxTimeSpan"`        // e.g. "7d"
+	MinGroupByInterval string   `json:"minGroupByInterval"` // finest GROUP BY time(), e.g. "1m"
+	RequireLimit       bool     `json:"requireLimit"`
+	RequireSLimit      bool     `json:"requireSLimit"`
+}
+
+// UserConfig Proxy user, with measurement globs or "keymap:<key>" groups
+// per permission
+type UserConfig struct {
+	Password string   `json:"password"` // plain, or "sha256:<hex>"
+	Admin    bool     `json:"admin"`
+	Read     []string `json:"read"`
+	Write    []string `json:"write"`
+	Delete   []string `json:"delete"`
+}
+
+// ProxyConfig Proxy node configuration. On /reload only db changes, and
+// dataDir and deadLetterMaxSize for the backends inheriting them, the
+// others need a restart.
 type ProxyConfig struct {
 	ListenAddr   string `json:"listenAddr"`
 	DB           string `json:"db"`
@@ -30,12 +94,21 @@ type ProxyConfig struct {
 	IdleTimeout  int    `json:"idleTimeout"`
 	WriteTracing int    `json:"writeTracing"`
 	QueryTracing int    `json:"queryTracing"`
+	SyncWrite    int    `json:"syncWrite"`    // wait for every write to be accepted
+	DataDir      string `json:"dataDir"`      // spill queues and dead letters, the working directory if empty
+	WriteWorkers int    `json:"writeWorkers"` // chunks of a write parsed at once, the number of CPUs by default
+	MaxBodySize  int64  `json:"maxBodySize"`  // bytes of a write body once decompressed, 0 for no limit
+
+	DeadLetterMaxSize int64 `json:"deadLetterMaxSize"` // bytes of each dead-letter store, the oldest dropped over it, 0 for no limit
+
+	QueryHedgeDelay int `json:"queryHedgeDelay"` // milliseconds before a query is also sent to a second replica, 0 never
+	QueryRace       int `json:"queryRace"`       // send a query to two replicas at once
 }
 
 // BackendConfig InfluxDB node configuration
 type BackendConfig struct {
 	URL             string `json:"url"`
-	DB              string `json:"db"`
+	DB              string `json:"db"` // empty to serve the database of each request
 	Zone            string `json:"zone"`
 	Interval        int    `json:"interval"`
 	Timeout         int    `json:"timeout"`
@@ -44,13 +117,49 @@ type BackendConfig struct {
 	CheckInterval   int    `json:"checkInterval"`
 	RewriteInterval int    `json:"rewriteInterval"`
 	WriteOnly       int    `json:"writeOnly"`
+	Username        string `json:"username"`
+	Password        string `json:"password"`
+	DataDir         string `json:"dataDir"` // the proxy dataDir if empty
+
+	DeadLetterMaxSize int64 `json:"deadLetterMaxSize"` // the proxy deadLetterMaxSize if 0
+
+	SpillSegmentSize int64  `json:"spillSegmentSize"` // bytes of a segment of the spill queue
+	SpillMaxSize     int64  `json:"spillMaxSize"`     // bytes of the spill queue, 0 for no limit
+	SpillMaxAge      int    `json:"spillMaxAge"`      // seconds, 0 for no limit
+	SpillPolicy      string `json:"spillPolicy"`      // over the limits, "drop-oldest" or "reject-new"
+
+	ReplayConcurrency int `json:"replayConcurrency"` // records of the spill queue replayed at once, in order only if 1, 1 by default
+	ReplayBytesRate   int `json:"replayBytesRate"`   // bytes a second, 0 for no limit
+	ReplayPointsRate  int `json:"replayPointsRate"`  // points a second, 0 for no limit
+
+	WriteQueueSize int    `json:"writeQueueSize"` // lines queued for the worker, 1024 by default
+	MaxFlushes     int    `json:"maxFlushes"`     // batches sent at once, 8 by default
+	MaxBufferSize  int64  `json:"maxBufferSize"`  // bytes batched or in flight, 64MB by default, -1 for no limit
+	OverloadPolicy string `json:"overloadPolicy"` // over the limits, "spill" to the spill queue or "reject" writes
+}
+
+func setShardDefaults(shards map[string]ShardKeymap) {
+	for name, shard := range shards {
+		if shard.Replication <= 0 {
+			shard.Replication = 1
+			shards[name] = shard
+		}
+	}
 }
 
 func LoadConfigFile(fileName string) (cfg *Config, err error) {
-	cfg = &Config{}
-	file, err := os.Open(fileName)
+	cfg, err = ReadConfigFile(fileName)
 	if err != nil {
 		log.Panic(err)
+	}
+	return
+}
+
+// ReadConfigFile is LoadConfigFile without panic, for reloading.
+func ReadConfigFile(fileName string) (cfg *Config, err error) {
+	cfg = &Config{filename: fileName}
+	file, err := os.Open(fileName)
+	if err != nil {
 		return
 	}
 	defer file.Close()
@@ -58,11 +167,16 @@ func LoadConfigFile(fileName string) (cfg *Config, err error) {
 	dec := json.NewDecoder(file)
 	err = dec.Decode(&cfg)
 	if err != nil {
-		log.Panic(err)
 		return
 	}
 
-	for _, backend := range cfg.Backends {
+	setShardDefaults(cfg.ShardKeymaps)
+	for _, db := range cfg.Databases {
+		setShardDefaults(db.ShardKeymaps)
+	}
+
+	// the backends are values, a default goes in the map again.
+	for name, backend := range cfg.Backends {
 		if backend.Interval == 0 {
 			backend.Interval = 1000
 		}
@@ -81,6 +195,7 @@ func LoadConfigFile(fileName string) (cfg *Config, err error) {
 		if backend.RewriteInterval == 0 {
 			backend.RewriteInterval = 10000
 		}
+		cfg.Backends[name] = backend
 	}
 	return
 }
@@ -0,0 +1,32 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReadConfigFileDefaults(t *testing.T) {
+	file, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer os.Remove(file.Name())
+	_, _ = file.WriteString(`{"backends":{"b1":{"url":"http://localhost:8086","timeoutQuery":1000}, "b2":{"url":"http://localhost:8086"}}}`)
+	file.Close()
+
+	cfg, err := ReadConfigFile(file.Name())
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if b := cfg.Backends["b1"]; b.TimeoutQuery != 1000 || b.Timeout != 10000 {
+		t.Errorf("b1: timeoutQuery %d, timeout %d", b.TimeoutQuery, b.Timeout)
+	}
+	if b := cfg.Backends["b2"]; b.TimeoutQuery != 600000 || b.MaxRowLimit != 10000 {
+		t.Errorf("b2: timeoutQuery %d, maxRowLimit %d", b.TimeoutQuery, b.MaxRowLimit)
+	}
+}
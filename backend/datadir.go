@@ -0,0 +1,126 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+var (
+	ErrDataLocked = errors.New("data locked by another backend")
+)
+
+// dataLock is the lock file which keeps any other backend, of this process
+// or another one, off the spill queue and the dead letters of a backend.
+type dataLock struct {
+	file *os.File
+}
+
+// lockData locks the data at path, the files named path plus a suffix.
+func lockData(path string) (dl *dataLock, err error) {
+	file, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		log.Print("open lock error: ", err)
+		return
+	}
+	err = flock(file)
+	if err != nil {
+		file.Close()
+		log.Printf("lock %s error: %s", path, err)
+		return nil, ErrDataLocked
+	}
+	return &dataLock{file: file}, nil
+}
+
+func (dl *dataLock) Unlock() {
+	dl.file.Close()
+}
+
+// dataPath makes dir and returns where the files of name go in it.
+func dataPath(dir string, name string) (path string, err error) {
+	if dir == "" {
+		return name, nil
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		log.Print("make data dir error: ", err)
+		return
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// dataFiles lists the files of the data at path, but the lock file.
+func dataFiles(path string) (files []string, err error) {
+	names, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		switch filepath.Ext(name) {
+		case ".dat", ".rec", ".dlq", ".corrupt":
+			files = append(files, name)
+		}
+	}
+	return
+}
+
+// migrateData moves the files left by older versions in the working
+// directory as name to path, unless there are files at path already.
+func migrateData(name string, path string) (err error) {
+	if filepath.Clean(path) == filepath.Clean(name) {
+		return
+	}
+	existing, err := dataFiles(path)
+	if err != nil || len(existing) > 0 {
+		return
+	}
+	files, err := dataFiles(name)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		suffix := file[len(name):]
+		log.Printf("migrate %s to %s", file, path+suffix)
+		err = moveFile(file, path+suffix)
+		if err != nil {
+			log.Print("migrate data error: ", err)
+			return
+		}
+	}
+	return
+}
+
+// moveFile renames, or copies and removes across devices.
+func moveFile(from string, to string) (err error) {
+	if os.Rename(from, to) == nil {
+		return
+	}
+
+	src, err := os.Open(from)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(to)
+		return
+	}
+	return os.Remove(from)
+}
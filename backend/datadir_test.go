@@ -0,0 +1,63 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestDataDir(t *testing.T) {
+	dir := t.TempDir()
+
+	// left in the working directory by an older version.
+	removeFileBackend("moved")
+	defer removeFileBackend("moved")
+	_ = ioutil.WriteFile("moved.dat", []byte{0, 0, 0, 4, 'a', 'a', 'a', 'a'}, 0644)
+	_ = ioutil.WriteFile("moved.dlq", []byte("{}\n"), 0644)
+
+	cfg, ts := CreateTestBackendConfig(t, "moved")
+	defer ts.Close()
+	cfg.DataDir = filepath.Join(dir, "data")
+	bs, err := NewBackend(cfg, "moved")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+
+	for _, name := range []string{"moved.00000000.dat", "moved.rec", "moved.dlq", "moved.lock"} {
+		if _, err = os.Stat(filepath.Join(cfg.DataDir, name)); err != nil {
+			t.Errorf("error: %s", err)
+		}
+	}
+	if files, _ := dataFiles("moved"); len(files) != 0 {
+		t.Errorf("left behind: %v", files)
+	}
+
+	if runtime.GOOS != "windows" {
+		// as another process would.
+		file, err := os.Open(filepath.Join(cfg.DataDir, "moved.lock"))
+		if err != nil {
+			t.Fatalf("error: %s", err)
+		}
+		if flock(file) == nil {
+			t.Errorf("locked twice")
+		}
+		file.Close()
+	}
+
+	// nor does another backend of this process share it, but once closed.
+	if _, err = NewBackend(cfg, "moved"); runtime.GOOS != "windows" && err != ErrDataLocked {
+		t.Errorf("opened twice: %v", err)
+	}
+	_ = bs.Close()
+	again, err := NewBackend(cfg, "moved")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	_ = again.Close()
+}
@@ -0,0 +1,413 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// ProxyDeadLetters names the store of the lines refused by the proxy
+	// itself, before any backend.
+	ProxyDeadLetters = "_proxy_"
+)
+
+var (
+	ErrDeadLettersNotFound = errors.New("dead letters not found")
+)
+
+// DeadLetter is a line which can't be written, kept for operators to
+// inspect and replay.
+type DeadLetter struct {
+	Time        time.Time `json:"time"`
+	Reason      string    `json:"reason"`
+	DB          string    `json:"db,omitempty"`
+	RP          string    `json:"rp,omitempty"`
+	Precision   string    `json:"precision,omitempty"`
+	Consistency string    `json:"consistency,omitempty"`
+	Line        string    `json:"line"`
+}
+
+func NewDeadLetter(key BatchKey, line []byte, reason error) *DeadLetter {
+	return &DeadLetter{
+		Time:        time.Now().UTC(),
+		Reason:      reason.Error(),
+		DB:          key.DB,
+		RP:          key.RP,
+		Precision:   key.Precision,
+		Consistency: key.Consistency,
+		Line:        string(line),
+	}
+}
+
+// BatchKey is the key the line was written with.
+func (dl *DeadLetter) BatchKey() BatchKey {
+	return BatchKey{DB: dl.DB, RP: dl.RP, Precision: dl.Precision, Consistency: dl.Consistency}
+}
+
+// units are the durations of the precisions a batch is sent with.
+var units = map[string]time.Duration{
+	"":   time.Nanosecond,
+	"u":  time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+// Replayed is the line to write again. A line without a timestamp gets the
+// time it was recorded, not the time it is replayed.
+func (dl *DeadLetter) Replayed() (line string) {
+	pt, err := ParsePoint([]byte(dl.Line))
+	if err != nil || pt == nil || pt.HasTime {
+		return dl.Line
+	}
+	unit, ok := units[dl.Precision]
+	if !ok {
+		return dl.Line
+	}
+	return string(pt.Line) + " " + strconv.FormatInt(dl.Time.UnixNano()/int64(unit), 10)
+}
+
+// DeadLetterFile appends dead letters to a file, one JSON object a line.
+// Over its maximum size, the oldest are dropped down to half of it.
+type DeadLetterFile struct {
+	lock     sync.Mutex
+	filename string
+	file     *os.File
+	size     int64 // bytes of the file
+	maxSize  int64 // bytes, 0 for no limit
+}
+
+func NewDeadLetterFile(filename string, maxSize int64) (df *DeadLetterFile, err error) {
+	df = &DeadLetterFile{filename: filename + ".dlq", maxSize: maxSize}
+	df.file, err = os.OpenFile(df.filename,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Print("open dead letter error: ", err)
+		return
+	}
+	fi, err := df.file.Stat()
+	if err != nil {
+		df.file.Close()
+		return
+	}
+	df.size = fi.Size()
+	return
+}
+
+func (df *DeadLetterFile) Write(letters ...*DeadLetter) (err error) {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+
+	var buf []byte
+	for _, dl := range letters {
+		p, err := json.Marshal(dl)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, p...), '\n')
+	}
+
+	if df.maxSize > 0 && df.size+int64(len(buf)) > df.maxSize {
+		err = df.trim(df.maxSize/2 - int64(len(buf)))
+		if err != nil {
+			log.Print("trim dead letter error: ", err)
+			return
+		}
+	}
+
+	n, err := df.file.Write(buf)
+	df.size += int64(n)
+	if err != nil {
+		log.Print("write dead letter error: ", err)
+		return
+	}
+	return df.file.Sync()
+}
+
+// trim drops the oldest dead letters, keeping the newest whole lines within
+// keep bytes.
+func (df *DeadLetterFile) trim(keep int64) (err error) {
+	if keep < 0 {
+		keep = 0
+	}
+	tmpname := df.filename + ".tmp"
+	n, err := df.copyTail(tmpname, keep)
+	if err != nil {
+		_ = os.Remove(tmpname)
+		return
+	}
+
+	// the file is closed first, as windows renames no open file.
+	df.file.Close()
+	err = os.Rename(tmpname, df.filename)
+	if err == nil {
+		log.Printf("dead letters %s over %d bytes, dropped %d bytes\n", df.filename, df.maxSize, df.size-n)
+		df.size = n
+	}
+	file, oerr := os.OpenFile(df.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if oerr != nil {
+		return oerr
+	}
+	df.file = file
+	return
+}
+
+// copyTail copies the lines starting within keep bytes of the end of the
+// file to a new file.
+func (df *DeadLetterFile) copyTail(filename string, keep int64) (n int64, err error) {
+	file, err := os.Open(df.filename)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	if df.size > keep {
+		_, err = file.Seek(df.size-keep-1, io.SeekStart)
+		if err != nil {
+			return
+		}
+		_, err = r.ReadSlice('\n')
+		for err == bufio.ErrBufferFull {
+			_, err = r.ReadSlice('\n')
+		}
+		if err == io.EOF {
+			err = nil
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	tmp, err := os.Create(filename)
+	if err != nil {
+		return
+	}
+	defer tmp.Close()
+	n, err = io.Copy(tmp, r)
+	if err != nil {
+		return
+	}
+	return n, tmp.Sync()
+}
+
+// Each calls fn on every dead letter in order, until fn returns false.
+func (df *DeadLetterFile) Each(fn func(dl *DeadLetter) bool) (err error) {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+	return df.each(fn)
+}
+
+func (df *DeadLetterFile) each(fn func(dl *DeadLetter) bool) (err error) {
+	file, err := os.Open(df.filename)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		dl := &DeadLetter{}
+		err = json.Unmarshal(scanner.Bytes(), dl)
+		if err != nil {
+			return
+		}
+		if !fn(dl) {
+			return
+		}
+	}
+	return scanner.Err()
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Open opens the file as it is now for reading, so that it can be read
+// without holding up the writers.
+func (df *DeadLetterFile) Open() (r io.ReadCloser, err error) {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+
+	file, err := os.Open(df.filename)
+	if err != nil {
+		return
+	}
+	return &readCloser{io.LimitReader(file, df.size), file}, nil
+}
+
+func (df *DeadLetterFile) Purge() (err error) {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+	df.size = 0
+	return df.file.Truncate(0)
+}
+
+// Take returns every dead letter and empties the file.
+func (df *DeadLetterFile) Take() (letters []*DeadLetter, err error) {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+
+	err = df.each(func(dl *DeadLetter) bool {
+		letters = append(letters, dl)
+		return true
+	})
+	if err != nil {
+		return
+	}
+	df.size = 0
+	return letters, df.file.Truncate(0)
+}
+
+func (df *DeadLetterFile) Close() {
+	df.file.Close()
+}
+
+// DeadLetterStat sums up a dead-letter store.
+type DeadLetterStat struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func (ic *InfluxCluster) deadLetterFiles() (files map[string]*DeadLetterFile) {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+
+	files = make(map[string]*DeadLetterFile)
+	if ic.deadLetters != nil {
+		files[ProxyDeadLetters] = ic.deadLetters
+	}
+	for name, b := range ic.backends {
+		files[name] = b.DeadLetters()
+	}
+	return
+}
+
+func (ic *InfluxCluster) deadLetterFile(name string) (df *DeadLetterFile, err error) {
+	df, ok := ic.deadLetterFiles()[name]
+	if !ok {
+		return nil, ErrDeadLettersNotFound
+	}
+	return
+}
+
+// DeadLetterStats tells how many dead letters every store holds.
+func (ic *InfluxCluster) DeadLetterStats() (stats []*DeadLetterStat, err error) {
+	for name, df := range ic.deadLetterFiles() {
+		stat := &DeadLetterStat{Name: name}
+		err = df.Each(func(*DeadLetter) bool {
+			stat.Count++
+			return true
+		})
+		if err != nil {
+			return
+		}
+		stats = append(stats, stat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	return
+}
+
+// ListDeadLetters returns up to limit dead letters of a store from offset,
+// all of them if limit isn't positive.
+func (ic *InfluxCluster) ListDeadLetters(name string, offset, limit int) (letters []*DeadLetter, err error) {
+	df, err := ic.deadLetterFile(name)
+	if err != nil {
+		return
+	}
+	letters = []*DeadLetter{}
+	i := 0
+	err = df.Each(func(dl *DeadLetter) bool {
+		if i >= offset {
+			letters = append(letters, dl)
+		}
+		i++
+		return limit <= 0 || len(letters) < limit
+	})
+	return
+}
+
+// DownloadDeadLetters opens a store as it is kept, for the caller to read
+// and close.
+func (ic *InfluxCluster) DownloadDeadLetters(name string) (r io.ReadCloser, err error) {
+	df, err := ic.deadLetterFile(name)
+	if err != nil {
+		return
+	}
+	return df.Open()
+}
+
+func (ic *InfluxCluster) PurgeDeadLetters(name string) (err error) {
+	df, err := ic.deadLetterFile(name)
+	if err != nil {
+		return
+	}
+	return df.Purge()
+}
+
+// ReplayDeadLetters writes the dead letters of a store again through the
+// routing, once the keymaps or the schema are fixed. Lines which fail again
+// are dead letters again. It returns how many lines were replayed.
+func (ic *InfluxCluster) ReplayDeadLetters(name string) (replayed int, err error) {
+	df, err := ic.deadLetterFile(name)
+	if err != nil {
+		return
+	}
+	letters, err := df.Take()
+	if err != nil {
+		return
+	}
+
+	var keys []BatchKey
+	batches := make(map[BatchKey][]*DeadLetter)
+	for _, dl := range letters {
+		key := dl.BatchKey()
+		if _, ok := batches[key]; !ok {
+			keys = append(keys, key)
+		}
+		batches[key] = append(batches[key], dl)
+	}
+
+	for _, key := range keys {
+		var buf bytes.Buffer
+		for _, dl := range batches[key] {
+			buf.WriteString(dl.Replayed())
+			buf.WriteByte('\n')
+		}
+		werr := ic.WriteWith(buf.Bytes(), &WriteOptions{
+			DB:          key.DB,
+			RP:          key.RP,
+			Precision:   key.Precision,
+			Consistency: key.Consistency,
+		})
+		if _, ok := werr.(*WriteError); werr != nil && !ok {
+			// nothing was written, keep them as they were.
+			log.Printf("replay dead letters error: %s\n", werr)
+			err = df.Write(batches[key]...)
+			if err != nil {
+				return
+			}
+			continue
+		}
+		replayed += len(batches[key])
+	}
+	return
+}
@@ -0,0 +1,77 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeadLetterFileMaxSize(t *testing.T) {
+	df, err := NewDeadLetterFile(filepath.Join(t.TempDir(), "test"), 1000)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer df.Close()
+
+	cause := errors.New("field type conflict")
+	for i := 0; i < 50; i++ {
+		err = df.Write(NewDeadLetter(BatchKey{DB: "test"}, []byte(fmt.Sprintf("cpu value=%d", i)), cause))
+		if err != nil {
+			t.Fatalf("error: %s", err)
+		}
+	}
+
+	fi, err := os.Stat(df.filename)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if fi.Size() > 1000 || fi.Size() != df.size {
+		t.Errorf("file of %d bytes, counted %d", fi.Size(), df.size)
+	}
+	var lines []string
+	err = df.Each(func(dl *DeadLetter) bool {
+		lines = append(lines, dl.Line)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if len(lines) == 0 || len(lines) == 50 || lines[len(lines)-1] != "cpu value=49" {
+		t.Errorf("kept %v", lines)
+	}
+	// the newest are kept, in order.
+	for i, line := range lines {
+		if want := fmt.Sprintf("cpu value=%d", 50-len(lines)+i); line != want {
+			t.Errorf("line %d is %q, want %q", i, line, want)
+		}
+	}
+}
+
+func TestDeadLetterReplayed(t *testing.T) {
+	at := time.Date(2020, 1, 2, 3, 4, 5, 6000, time.UTC)
+	tests := []struct {
+		name      string
+		line      string
+		precision string
+		want      string
+	}{
+		{"nanoseconds", "cpu,host=a value=1", "", "cpu,host=a value=1 1577934245000006000"},
+		{"seconds", "cpu value=1", "s", "cpu value=1 1577934245"},
+		{"hours", "cpu value=1", "h", "cpu value=1 438315"},
+		{"timestamp", "cpu value=1 10", "s", "cpu value=1 10"},
+		{"unparsable", "cpu", "", "cpu"},
+	}
+	for _, tt := range tests {
+		dl := &DeadLetter{Time: at, Precision: tt.precision, Line: tt.line}
+		if got := dl.Replayed(); got != tt.want {
+			t.Errorf("%s: replayed %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
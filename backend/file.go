@@ -5,86 +5,472 @@
 package backend
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 )
 
+const (
+	SpillDropOldest = "drop-oldest"
+	SpillRejectNew  = "reject-new"
+
+	DefaultSpillSegmentSize = 64 * 1024 * 1024
+
+	// segmentVersion is the format of the segments written. Version 0, of
+	// the single data file of older versions, has neither header nor CRC,
+	// and version 1 records don't tell when they were written.
+	segmentVersion = 2
+	segmentMagic   = "IPSQ"
+	headerSize     = 8 // magic and version
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	ErrSpillFull          = errors.New("spill queue full")
+	ErrInvalidSpillPolicy = errors.New("invalid spill policy")
+	ErrCorruptRecord      = errors.New("corrupt record")
+)
+
+// segment is a file of the log. From version 1 it starts with a header,
+// and records are appended to it as length, CRC of the data, the time
+// written in nanoseconds, and data.
+type segment struct {
+	seq     uint64
+	version uint32
+	size    int64
+	modTime time.Time
+}
+
+// start is the offset of the first record.
+func (seg *segment) start() int64 {
+	if seg.version == 0 {
+		return 0
+	}
+	return headerSize
+}
+
+func (seg *segment) recordHeaderSize() int64 {
+	switch seg.version {
+	case 0:
+		return 4
+	case 1:
+		return 8
+	}
+	return 16
+}
+
+// FileBackend is a log of records spilled to disk, split in segments. The
+// meta file keeps the segment and offset replay has reached, and segments
+// are deleted once replay has passed them. The log is bounded by size and
+// age, dropping the oldest segments or refusing new records.
 type FileBackend struct {
-	lock     sync.Mutex
-	filename string
-	dataflag bool
-	producer *os.File
-	consumer *os.File
-	meta     *os.File
+	lock        sync.Mutex
+	filename    string
+	segmentSize int64
+	maxSize     int64
+	maxAge      time.Duration
+	policy      string
+	dataflag    bool
+	segments    []*segment // oldest first, the producer last
+	producer    *os.File
+	consumer    *os.File
+	readSeq     uint64
+	readOff     int64
+	metaSeq     uint64
+	metaOff     int64
+	meta        *os.File
+	quarantine  *os.File // corrupt records, opened on the first one
 }
 
-func NewFileBackend(filename string) (fb *FileBackend, err error) {
+// NewFileBackend opens the log of filename, limited as cfg says. A nil cfg
+// gives an unbounded log.
+func NewFileBackend(filename string, cfg *BackendConfig) (fb *FileBackend, err error) {
 	fb = &FileBackend{
-		filename: filename,
-		dataflag: false,
+		filename:    filename,
+		segmentSize: DefaultSpillSegmentSize,
+		policy:      SpillDropOldest,
+		dataflag:    false,
+	}
+	defer func() {
+		if err != nil && fb != nil {
+			fb.Close()
+		}
+	}()
+	if cfg != nil {
+		if cfg.SpillSegmentSize > 0 {
+			fb.segmentSize = cfg.SpillSegmentSize
+		}
+		fb.maxSize = cfg.SpillMaxSize
+		fb.maxAge = time.Duration(cfg.SpillMaxAge) * time.Second
+		switch cfg.SpillPolicy {
+		case "":
+		case SpillDropOldest, SpillRejectNew:
+			fb.policy = cfg.SpillPolicy
+		default:
+			return nil, ErrInvalidSpillPolicy
+		}
 	}
 
-	fb.producer, err = os.OpenFile(filename+".dat",
+	fb.meta, err = os.OpenFile(filename+".rec",
+		os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		log.Print("open meta error: ", err)
+		return
+	}
+
+	err = fb.loadSegments()
+	if err != nil {
+		return
+	}
+
+	last := fb.segments[len(fb.segments)-1]
+	fb.producer, err = os.OpenFile(fb.segmentName(last.seq),
 		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
 		log.Print("open producer error: ", err)
 		return
 	}
 
-	fb.consumer, err = os.OpenFile(filename+".dat",
-		os.O_RDONLY, 0644)
+	err = fb.RollbackMeta()
 	if err != nil {
-		log.Print("open consumer error: ", err)
+		log.Print("rollback meta error: ", err)
 		return
 	}
+	fb.dataflag = fb.unread()
+	return
+}
 
-	fb.meta, err = os.OpenFile(filename+".rec",
-		os.O_RDWR|os.O_CREATE, 0644)
+func (fb *FileBackend) segmentName(seq uint64) string {
+	return fmt.Sprintf("%s.%08d.dat", fb.filename, seq)
+}
+
+// loadSegments finds the segments on disk, and makes the single data file
+// of older versions the first segment.
+func (fb *FileBackend) loadSegments() (err error) {
+	names, err := filepath.Glob(fb.filename + ".*.dat")
 	if err != nil {
-		log.Print("open meta error: ", err)
 		return
 	}
+	for _, name := range names {
+		var seq uint64
+		_, err = fmt.Sscanf(name[len(fb.filename):], ".%08d.dat", &seq)
+		if err != nil || fb.segmentName(seq) != name {
+			err = nil
+			continue
+		}
+		seg, err := loadSegment(name, seq)
+		if err != nil {
+			return err
+		}
+		fb.segments = append(fb.segments, seg)
+	}
+	sort.Slice(fb.segments, func(i, j int) bool {
+		return fb.segments[i].seq < fb.segments[j].seq
+	})
+
+	legacy := fb.filename + ".dat"
+	if fi, serr := os.Stat(legacy); serr == nil && fi.Size() == 0 {
+		_ = os.Remove(legacy)
+	} else if serr == nil {
+		var seq uint64
+		if n := len(fb.segments); n > 0 {
+			// an older version ran since the segments were made. Its
+			// records are replayed after theirs, rather than lost.
+			err = fb.recover(fb.segments[n-1])
+			if err != nil {
+				return
+			}
+			seq = fb.segments[n-1].seq + 1
+		}
+		log.Printf("migrate %s to segment %d", legacy, seq)
+		err = os.Rename(legacy, fb.segmentName(seq))
+		if err != nil {
+			return
+		}
+		fb.segments = append(fb.segments, &segment{seq: seq, version: 0, size: fi.Size(), modTime: fi.ModTime()})
+	}
 
-	err = fb.RollbackMeta()
+	if len(fb.segments) == 0 {
+		fb.segments = append(fb.segments, &segment{seq: 0, version: segmentVersion, modTime: time.Now()})
+	}
+	// only the segment written last may end with a torn record.
+	return fb.recover(fb.segments[len(fb.segments)-1])
+}
+
+// loadSegment tells the version and size of a segment on disk.
+func loadSegment(name string, seq uint64) (seg *segment, err error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	fi, err := file.Stat()
 	if err != nil {
-		err = nil
+		return
+	}
+
+	seg = &segment{seq: seq, version: segmentVersion, size: fi.Size(), modTime: fi.ModTime()}
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(file, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// a torn header is for recover to truncate.
+		if !bytes.HasPrefix([]byte(segmentMagic), header[:n]) {
+			seg.version = 0
+		}
+		return seg, nil
+	}
+	if err != nil {
+		return
+	}
+	if string(header[:4]) != segmentMagic {
+		seg.version = 0
+		return
+	}
+	seg.version = binary.BigEndian.Uint32(header[4:])
+	if seg.version > segmentVersion {
+		return nil, fmt.Errorf("segment %s: unknown version %d", name, seg.version)
 	}
 	return
 }
 
+// recover truncates the record a crash left halfway written at the end of
+// a segment.
+func (fb *FileBackend) recover(seg *segment) (err error) {
+	name := fb.segmentName(seg.seq)
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	end := int64(0)
+	if seg.size >= seg.start() {
+		end = seg.start()
+		hdr := make([]byte, 4)
+		for end+seg.recordHeaderSize() <= seg.size {
+			_, err = file.ReadAt(hdr, end)
+			if err != nil {
+				return
+			}
+			next := end + seg.recordHeaderSize() + int64(binary.BigEndian.Uint32(hdr))
+			if next > seg.size {
+				break
+			}
+			end = next
+		}
+	}
+	if end == seg.size {
+		return
+	}
+
+	log.Printf("truncate torn record of %s at %d, %d bytes", name, end, seg.size-end)
+	err = os.Truncate(name, end)
+	if err != nil {
+		return
+	}
+	seg.size = end
+	if end == 0 {
+		seg.version = segmentVersion
+	}
+	return
+}
+
+func (fb *FileBackend) totalSize() (size int64) {
+	for _, seg := range fb.segments {
+		size += seg.size
+	}
+	return
+}
+
+// unread tells whether replay hasn't reached the end of the log.
+func (fb *FileBackend) unread() bool {
+	last := fb.segments[len(fb.segments)-1]
+	return fb.metaSeq < last.seq || fb.metaOff < last.size
+}
+
 func (fb *FileBackend) Write(p []byte) (err error) {
 	fb.lock.Lock()
 	defer fb.lock.Unlock()
 
-	var length uint32 = uint32(len(p))
-	err = binary.Write(fb.producer, binary.BigEndian, length)
+	err = fb.expire()
 	if err != nil {
-		log.Print("write length error: ", err)
 		return
 	}
 
-	n, err := fb.producer.Write(p)
+	length := int64(16 + len(p))
+	for fb.maxSize > 0 && fb.totalSize()+length > fb.maxSize {
+		if fb.policy == SpillRejectNew || fb.totalSize() == 0 {
+			return ErrSpillFull
+		}
+		err = fb.dropOldest("size")
+		if err != nil {
+			return
+		}
+	}
+
+	producer := fb.segments[len(fb.segments)-1]
+	if producer.size > 0 && producer.size+length > fb.segmentSize {
+		err = fb.rotate()
+		if err != nil {
+			return
+		}
+		producer = fb.segments[len(fb.segments)-1]
+	}
+
+	if producer.size > 0 && producer.version != segmentVersion {
+		err = fb.rotate()
+		if err != nil {
+			return
+		}
+		producer = fb.segments[len(fb.segments)-1]
+	}
+
+	var buf []byte
+	if producer.size == 0 {
+		buf = append([]byte(segmentMagic), 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(buf[4:], segmentVersion)
+	}
+	rec := make([]byte, length)
+	binary.BigEndian.PutUint32(rec, uint32(len(p)))
+	binary.BigEndian.PutUint32(rec[4:], crc32.Checksum(p, crcTable))
+	binary.BigEndian.PutUint64(rec[8:], uint64(time.Now().UnixNano()))
+	copy(rec[16:], p)
+	buf = append(buf, rec...)
+	n, err := fb.producer.Write(buf)
+	producer.size += int64(n)
 	if err != nil {
 		log.Print("write error: ", err)
 		return
 	}
-	if n != len(p) {
-		return io.ErrShortWrite
-	}
 
 	err = fb.producer.Sync()
 	if err != nil {
-		log.Print("sync meta error: ", err)
+		log.Print("sync segment error: ", err)
 		return
 	}
 
+	producer.modTime = time.Now()
 	fb.dataflag = true
 	return
 }
 
+// rotate starts a new segment for the producer.
+func (fb *FileBackend) rotate() (err error) {
+	seq := fb.segments[len(fb.segments)-1].seq + 1
+	producer, err := os.OpenFile(fb.segmentName(seq),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		log.Print("open producer error: ", err)
+		return
+	}
+	fb.producer.Close()
+	fb.producer = producer
+	fb.segments = append(fb.segments, &segment{seq: seq, version: segmentVersion, modTime: time.Now()})
+	return
+}
+
+// Expire drops the segments last written before the maximum age, for a
+// queue nobody writes or reads to age all the same.
+func (fb *FileBackend) Expire() (err error) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	return fb.expire()
+}
+
+// expire drops the segments last written before the maximum age.
+func (fb *FileBackend) expire() (err error) {
+	if fb.maxAge <= 0 {
+		return
+	}
+	deadline := time.Now().Add(-fb.maxAge)
+	for fb.segments[0].size > 0 && fb.segments[0].modTime.Before(deadline) {
+		err = fb.dropOldest("age")
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// dropOldest deletes the oldest segment, consumed or not, and moves replay
+// past it.
+func (fb *FileBackend) dropOldest(reason string) (err error) {
+	if len(fb.segments) == 1 {
+		err = fb.rotate()
+		if err != nil {
+			return
+		}
+	}
+	oldest, next := fb.segments[0], fb.segments[1]
+	if fb.metaSeq <= oldest.seq {
+		log.Printf("spill queue %s over %s limit, drop %d bytes", fb.filename, reason, oldest.size-fb.metaOff)
+		fb.metaSeq, fb.metaOff = next.seq, 0
+		err = fb.writeMeta()
+		if err != nil {
+			return
+		}
+	}
+	if fb.readSeq <= oldest.seq {
+		err = fb.openConsumer(next.seq, 0)
+		if err != nil {
+			return
+		}
+	}
+	fb.segments = fb.segments[1:]
+	err = os.Remove(fb.segmentName(oldest.seq))
+	if err != nil {
+		log.Print("remove segment error: ", err)
+	}
+	fb.dataflag = fb.unread()
+	return
+}
+
+func (fb *FileBackend) openConsumer(seq uint64, off int64) (err error) {
+	if i := fb.segmentIndex(seq); i >= 0 && off < fb.segments[i].start() {
+		off = fb.segments[i].start()
+	}
+	if fb.consumer == nil || seq != fb.readSeq {
+		consumer, err := os.OpenFile(fb.segmentName(seq), os.O_RDONLY, 0644)
+		if err != nil {
+			log.Print("open consumer error: ", err)
+			return err
+		}
+		if fb.consumer != nil {
+			fb.consumer.Close()
+		}
+		fb.consumer = consumer
+	}
+	_, err = fb.consumer.Seek(off, io.SeekStart)
+	if err != nil {
+		log.Print("seek consumer error: ", err)
+		return
+	}
+	fb.readSeq, fb.readOff = seq, off
+	return
+}
+
+func (fb *FileBackend) segmentIndex(seq uint64) int {
+	for i, seg := range fb.segments {
+		if seg.seq == seq {
+			return i
+		}
+	}
+	return -1
+}
+
 func (fb *FileBackend) IsData() (dataflag bool) {
 	fb.lock.Lock()
 	defer fb.lock.Unlock()
@@ -93,18 +479,60 @@ func (fb *FileBackend) IsData() (dataflag bool) {
 
 // FIXME: signal here
 func (fb *FileBackend) Read() (p []byte, err error) {
-	if !fb.IsData() {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+
+	err = fb.expire()
+	if err != nil {
+		return
+	}
+	if !fb.dataflag {
 		return nil, nil
 	}
 
-	var length uint32
+	for {
+		// go on with the next segment once this one is read.
+		i := fb.segmentIndex(fb.readSeq)
+		for i >= 0 && i < len(fb.segments)-1 && fb.readOff >= fb.segments[i].size {
+			i++
+			err = fb.openConsumer(fb.segments[i].seq, 0)
+			if err != nil {
+				return
+			}
+		}
+		if i < 0 || fb.readOff >= fb.segments[i].size {
+			return nil, nil
+		}
+
+		p, err = fb.readRecord(fb.segments[i])
+		if err != ErrCorruptRecord {
+			return
+		}
+	}
+}
 
-	err = binary.Read(fb.consumer, binary.BigEndian, &length)
+// readRecord reads the record at the consumer. A corrupt one is moved to
+// quarantine and skipped, with the rest of the segment if its length can't
+// be right.
+func (fb *FileBackend) readRecord(seg *segment) (p []byte, err error) {
+	hdr := make([]byte, seg.recordHeaderSize())
+	_, err = io.ReadFull(fb.consumer, hdr)
 	if err != nil {
 		log.Print("read length error: ", err)
 		return
 	}
 
+	length := int64(binary.BigEndian.Uint32(hdr))
+	end := fb.readOff + int64(len(hdr)) + length
+	if end > seg.size {
+		log.Printf("corrupt record length %d at %d of %s", length, fb.readOff, fb.segmentName(seg.seq))
+		err = fb.skipCorrupt(seg, seg.size)
+		if err != nil {
+			return
+		}
+		return nil, ErrCorruptRecord
+	}
+
 	p = make([]byte, length)
 
 	_, err = io.ReadFull(fb.consumer, p)
@@ -112,32 +540,66 @@ func (fb *FileBackend) Read() (p []byte, err error) {
 		log.Print("read error: ", err)
 		return
 	}
+
+	if seg.version > 0 && crc32.Checksum(p, crcTable) != binary.BigEndian.Uint32(hdr[4:]) {
+		log.Printf("corrupt record crc at %d of %s", fb.readOff, fb.segmentName(seg.seq))
+		err = fb.skipCorrupt(seg, end)
+		if err != nil {
+			return
+		}
+		return nil, ErrCorruptRecord
+	}
+	fb.readOff = end
 	return
 }
 
-func (fb *FileBackend) CleanUp() (err error) {
-	_, err = fb.consumer.Seek(0, os.SEEK_SET)
-	if err != nil {
-		log.Print("seek consumer error: ", err)
-		return
+// skipCorrupt copies the bytes from the consumer up to end to quarantine,
+// and goes on reading from end.
+func (fb *FileBackend) skipCorrupt(seg *segment, end int64) (err error) {
+	if fb.quarantine == nil {
+		fb.quarantine, err = os.OpenFile(fb.filename+".corrupt",
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Print("open quarantine error: ", err)
+			return
+		}
 	}
 
-	err = fb.producer.Truncate(0)
+	buf := make([]byte, end-fb.readOff)
+	_, err = fb.consumer.ReadAt(buf, fb.readOff)
+	if err != nil && err != io.EOF {
+		log.Print("read corrupt record error: ", err)
+		return
+	}
+	_, err = fb.quarantine.Write(buf)
 	if err != nil {
-		log.Print("truncate error: ", err)
+		log.Print("write quarantine error: ", err)
 		return
 	}
+	return fb.openConsumer(seg.seq, end)
+}
 
-	err = fb.producer.Close()
+// CleanUp empties the log once replay has read it all.
+func (fb *FileBackend) CleanUp() (err error) {
+	for len(fb.segments) > 1 {
+		err = os.Remove(fb.segmentName(fb.segments[0].seq))
+		if err != nil {
+			log.Print("remove segment error: ", err)
+			return
+		}
+		fb.segments = fb.segments[1:]
+	}
+
+	err = fb.producer.Truncate(0)
 	if err != nil {
-		log.Print("close producer error: ", err)
+		log.Print("truncate error: ", err)
 		return
 	}
+	fb.segments[0].size = 0
+	fb.segments[0].version = segmentVersion
 
-	fb.producer, err = os.OpenFile(fb.filename+".dat",
-		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	err = fb.openConsumer(fb.segments[0].seq, 0)
 	if err != nil {
-		log.Print("open producer error: ", err)
 		return
 	}
 
@@ -145,39 +607,63 @@ func (fb *FileBackend) CleanUp() (err error) {
 	return
 }
 
-func (fb *FileBackend) UpdateMeta() (err error) {
+// Position is where replay has read up to in the log.
+type Position struct {
+	Seq uint64
+	Off int64
+}
+
+// Position returns where replay has read up to.
+func (fb *FileBackend) Position() (pos Position) {
 	fb.lock.Lock()
 	defer fb.lock.Unlock()
+	return Position{Seq: fb.readSeq, Off: fb.readOff}
+}
 
-	off_producer, err := fb.producer.Seek(0, os.SEEK_CUR)
-	if err != nil {
-		log.Print("OK")
-		log.Print("seek producer error: ", err)
-		return
-	}
+// Rewind moves replay back to a position it has read up to, for UpdateMeta
+// to record that only the records before it were replayed.
+func (fb *FileBackend) Rewind(pos Position) (err error) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	return fb.openConsumer(pos.Seq, pos.Off)
+}
 
-	off, err := fb.consumer.Seek(0, os.SEEK_CUR)
-	if err != nil {
-		log.Print("seek consumer error: ", err)
-		return
-	}
+// UpdateMeta records what replay has read, and deletes the segments it
+// has passed.
+func (fb *FileBackend) UpdateMeta() (err error) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
 
-	if off_producer == off {
+	last := fb.segments[len(fb.segments)-1]
+	if fb.readSeq == last.seq && fb.readOff >= last.size {
 		err = fb.CleanUp()
 		if err != nil {
 			return
 		}
-		off = 0
 	}
 
-	_, err = fb.meta.Seek(0, os.SEEK_SET)
+	for len(fb.segments) > 1 && fb.segments[0].seq < fb.readSeq {
+		err = os.Remove(fb.segmentName(fb.segments[0].seq))
+		if err != nil {
+			log.Print("remove segment error: ", err)
+			return
+		}
+		fb.segments = fb.segments[1:]
+	}
+
+	fb.metaSeq, fb.metaOff = fb.readSeq, fb.readOff
+	log.Printf("write meta: %d %d", fb.metaSeq, fb.metaOff)
+	return fb.writeMeta()
+}
+
+func (fb *FileBackend) writeMeta() (err error) {
+	_, err = fb.meta.Seek(0, io.SeekStart)
 	if err != nil {
 		log.Print("seek meta error: ", err)
 		return
 	}
 
-	log.Printf("write meta: %d", off)
-	err = binary.Write(fb.meta, binary.BigEndian, &off)
+	err = binary.Write(fb.meta, binary.BigEndian, []int64{int64(fb.metaSeq), fb.metaOff})
 	if err != nil {
 		log.Print("write meta error: ", err)
 		return
@@ -188,37 +674,160 @@ func (fb *FileBackend) UpdateMeta() (err error) {
 		log.Print("sync meta error: ", err)
 		return
 	}
-
 	return
 }
 
+// RollbackMeta moves replay back to what was recorded. A meta file of
+// older versions only holds the offset in the first segment.
 func (fb *FileBackend) RollbackMeta() (err error) {
 	fb.lock.Lock()
 	defer fb.lock.Unlock()
 
-	_, err = fb.meta.Seek(0, os.SEEK_SET)
+	_, err = fb.meta.Seek(0, io.SeekStart)
 	if err != nil {
 		log.Print("seek meta error: ", err)
 		return
 	}
 
-	var off int64
-	err = binary.Read(fb.meta, binary.BigEndian, &off)
+	buf := make([]byte, 16)
+	n, err := io.ReadFull(fb.meta, buf)
+	switch {
+	case err == nil:
+		fb.metaSeq = binary.BigEndian.Uint64(buf)
+		fb.metaOff = int64(binary.BigEndian.Uint64(buf[8:]))
+	case n == 8:
+		fb.metaSeq = fb.segments[0].seq
+		fb.metaOff = int64(binary.BigEndian.Uint64(buf))
+	default:
+		fb.metaSeq, fb.metaOff = fb.segments[0].seq, 0
+	}
+	err = nil
+
+	// the recorded segment is gone, dropped or consumed.
+	if fb.segmentIndex(fb.metaSeq) < 0 {
+		fb.metaSeq, fb.metaOff = fb.segments[0].seq, 0
+	}
+	return fb.openConsumer(fb.metaSeq, fb.metaOff)
+}
+
+// QueueStat tells what the log holds from where replay has reached.
+type QueueStat struct {
+	Bytes    int64      `json:"bytes"`
+	Records  int64      `json:"records"`
+	Segments int        `json:"segments"`
+	Oldest   *time.Time `json:"oldest,omitempty"` // when the oldest record was written
+	Segment  uint64     `json:"segment"`
+	Offset   int64      `json:"offset"`
+}
+
+// Stat counts the records replay hasn't passed. Records of older versions
+// tell no time, their segment is taken as written when last modified.
+func (fb *FileBackend) Stat() (stat *QueueStat, err error) {
+	fb.lock.Lock()
+	err = fb.expire()
 	if err != nil {
-		log.Print("read meta error: ", err)
+		fb.lock.Unlock()
 		return
 	}
+	stat = &QueueStat{Segment: fb.metaSeq, Offset: fb.metaOff}
+	var segments []segment
+	if first := fb.segmentIndex(fb.metaSeq); first >= 0 {
+		for _, seg := range fb.segments[first:] {
+			segments = append(segments, *seg)
+		}
+	}
+	fb.lock.Unlock()
+
+	// the records are counted without the lock, not to hold up spilling,
+	// up to the sizes seen. A segment dropped meanwhile is skipped.
+	for i := range segments {
+		seg := &segments[i]
+		off := seg.start()
+		if seg.seq == stat.Segment && stat.Offset > off {
+			off = stat.Offset
+		}
+		if off >= seg.size {
+			continue
+		}
+
+		var records int64
+		var oldest time.Time
+		records, oldest, err = fb.scanSegment(seg, off)
+		if os.IsNotExist(err) {
+			err = nil
+			continue
+		}
+		if err != nil {
+			return
+		}
+		stat.Segments++
+		stat.Bytes += seg.size - off
+		stat.Records += records
+		if stat.Oldest == nil && records > 0 {
+			stat.Oldest = &oldest
+		}
+	}
+	return
+}
 
-	_, err = fb.consumer.Seek(off, os.SEEK_SET)
+// scanSegment counts the records of a segment from off, and tells when
+// the first was written.
+func (fb *FileBackend) scanSegment(seg *segment, off int64) (records int64, first time.Time, err error) {
+	file, err := os.Open(fb.segmentName(seg.seq))
 	if err != nil {
-		log.Print("seek consumer error: ", err)
 		return
 	}
+	defer file.Close()
+
+	first = seg.modTime
+	hdr := make([]byte, seg.recordHeaderSize())
+	for off+int64(len(hdr)) <= seg.size {
+		_, err = file.ReadAt(hdr, off)
+		if err != nil {
+			return
+		}
+		if records == 0 && seg.version >= 2 {
+			first = time.Unix(0, int64(binary.BigEndian.Uint64(hdr[8:])))
+		}
+		records++
+		off += int64(len(hdr)) + int64(binary.BigEndian.Uint32(hdr))
+	}
 	return
 }
 
+// Purge drops every record, whether replay has passed it or not.
+func (fb *FileBackend) Purge() (err error) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+
+	log.Printf("purge spill queue %s, %d bytes", fb.filename, fb.totalSize())
+	err = fb.rotate()
+	if err != nil {
+		return
+	}
+	last := fb.segments[len(fb.segments)-1]
+	err = fb.openConsumer(last.seq, 0)
+	if err != nil {
+		return
+	}
+	for _, seg := range fb.segments[:len(fb.segments)-1] {
+		err = os.Remove(fb.segmentName(seg.seq))
+		if err != nil {
+			log.Print("remove segment error: ", err)
+			return
+		}
+	}
+	fb.segments = []*segment{last}
+	fb.metaSeq, fb.metaOff = fb.readSeq, fb.readOff
+	fb.dataflag = false
+	return fb.writeMeta()
+}
+
 func (fb *FileBackend) Close() {
 	fb.producer.Close()
 	fb.consumer.Close()
 	fb.meta.Close()
+	if fb.quarantine != nil {
+		fb.quarantine.Close()
+	}
 }
@@ -6,8 +6,12 @@ package backend
 
 import (
 	"bytes"
+	"encoding/binary"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func readAndProcess(t *testing.T, fb *FileBackend, s string, l int64) {
@@ -28,7 +32,7 @@ func readAndProcess(t *testing.T, fb *FileBackend, s string, l int64) {
 		return
 	}
 
-	fi, err := os.Stat("../testbk.dat")
+	fi, err := os.Stat(fb.segmentName(fb.segments[0].seq))
 	if err != nil {
 		t.Errorf("error: %s", err)
 		return
@@ -42,12 +46,21 @@ func readAndProcess(t *testing.T, fb *FileBackend, s string, l int64) {
 	return
 }
 
+func removeFileBackend(name string) {
+	files, _ := dataFiles(name)
+	for _, file := range append(files, name+".lock") {
+		_ = os.Remove(file)
+	}
+}
+
 func TestFileBackend(t *testing.T) {
-	fb, err := NewFileBackend("../testbk")
+	testbk := filepath.Join(t.TempDir(), "testbk")
+	fb, err := NewFileBackend(testbk, nil)
 	if err != nil {
 		t.Errorf("error: %s", err)
 		return
 	}
+	defer fb.Close()
 
 	err = fb.Write([]byte("data"))
 	if err != nil {
@@ -61,6 +74,238 @@ func TestFileBackend(t *testing.T) {
 		return
 	}
 
-	readAndProcess(t, fb, "data", 16)
+	readAndProcess(t, fb, "data", 48)
 	readAndProcess(t, fb, "full", 0)
 }
+
+func TestFileBackendSegments(t *testing.T) {
+	segments := filepath.Join(t.TempDir(), "segments")
+	cfg := &BackendConfig{SpillSegmentSize: 48}
+	fb, err := NewFileBackend(segments, cfg)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+
+	for _, s := range []string{"aaaa", "bbbb", "cccc", "dddd", "eeee"} {
+		err = fb.Write([]byte(s))
+		if err != nil {
+			t.Fatalf("error: %s", err)
+		}
+	}
+	if len(fb.segments) != 3 {
+		t.Fatalf("got %d segments, want 3", len(fb.segments))
+	}
+
+	for _, s := range []string{"aaaa", "bbbb", "cccc"} {
+		p, err := fb.Read()
+		if err != nil || string(p) != s {
+			t.Fatalf("read %q %v, want %q", p, err, s)
+		}
+	}
+	err = fb.UpdateMeta()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if _, err = os.Stat(fb.segmentName(0)); !os.IsNotExist(err) {
+		t.Errorf("consumed segment not deleted")
+	}
+
+	// replay starts again where it was recorded.
+	fb.Close()
+	fb, err = NewFileBackend(segments, cfg)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer fb.Close()
+	for _, s := range []string{"dddd", "eeee"} {
+		p, err := fb.Read()
+		if err != nil || string(p) != s {
+			t.Fatalf("read %q %v, want %q", p, err, s)
+		}
+	}
+	err = fb.UpdateMeta()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if fb.IsData() || len(fb.segments) != 1 || fb.totalSize() != 0 {
+		t.Errorf("not cleaned up: %d segments, %d bytes", len(fb.segments), fb.totalSize())
+	}
+}
+
+func TestFileBackendMaxSize(t *testing.T) {
+	maxsize := filepath.Join(t.TempDir(), "maxsize")
+	fb, err := NewFileBackend(maxsize, &BackendConfig{SpillSegmentSize: 48, SpillMaxSize: 96})
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer fb.Close()
+
+	for _, s := range []string{"aaaa", "bbbb", "cccc", "dddd", "eeee"} {
+		err = fb.Write([]byte(s))
+		if err != nil {
+			t.Fatalf("error: %s", err)
+		}
+	}
+	// the segment of aaaa and bbbb was dropped.
+	for _, s := range []string{"cccc", "dddd", "eeee"} {
+		p, err := fb.Read()
+		if err != nil || string(p) != s {
+			t.Fatalf("read %q %v, want %q", p, err, s)
+		}
+	}
+
+	reject := filepath.Join(t.TempDir(), "reject")
+	fb, err = NewFileBackend(reject, &BackendConfig{SpillMaxSize: 48, SpillPolicy: SpillRejectNew})
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer fb.Close()
+	for _, s := range []string{"aaaa", "bbbb"} {
+		err = fb.Write([]byte(s))
+		if err != nil {
+			t.Fatalf("error: %s", err)
+		}
+	}
+	if err = fb.Write([]byte("cccc")); err != ErrSpillFull {
+		t.Errorf("want the spill queue full, got %v", err)
+	}
+
+	_, err = NewFileBackend(reject, &BackendConfig{SpillPolicy: "drop-newest"})
+	if err != ErrInvalidSpillPolicy {
+		t.Errorf("want an invalid policy, got %v", err)
+	}
+}
+
+func TestFileBackendMigrate(t *testing.T) {
+	legacy := filepath.Join(t.TempDir(), "legacy")
+	var buf bytes.Buffer
+	for _, s := range []string{"aaaa", "bbbb"} {
+		_ = binary.Write(&buf, binary.BigEndian, uint32(len(s)))
+		buf.WriteString(s)
+	}
+	_ = ioutil.WriteFile(legacy+".dat", buf.Bytes(), 0644)
+	var off bytes.Buffer
+	_ = binary.Write(&off, binary.BigEndian, int64(8))
+	_ = ioutil.WriteFile(legacy+".rec", off.Bytes(), 0644)
+
+	fb, err := NewFileBackend(legacy, nil)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer fb.Close()
+	p, err := fb.Read()
+	if err != nil || string(p) != "bbbb" {
+		t.Errorf("read %q %v, want bbbb", p, err)
+	}
+	if _, err = os.Stat(legacy + ".dat"); !os.IsNotExist(err) {
+		t.Errorf("legacy file left")
+	}
+}
+
+func TestFileBackendMigrateAfterSegments(t *testing.T) {
+	legacy2 := filepath.Join(t.TempDir(), "legacy2")
+	fb, err := NewFileBackend(legacy2, nil)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	err = fb.Write([]byte("aaaa"))
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	fb.Close()
+
+	// an older version left its data file since.
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.BigEndian, uint32(4))
+	buf.WriteString("bbbb")
+	_ = ioutil.WriteFile(legacy2+".dat", buf.Bytes(), 0644)
+
+	fb, err = NewFileBackend(legacy2, nil)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer fb.Close()
+	if err = fb.Write([]byte("cccc")); err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	for _, s := range []string{"aaaa", "bbbb", "cccc"} {
+		p, err := fb.Read()
+		if err != nil || string(p) != s {
+			t.Fatalf("read %q %v, want %q", p, err, s)
+		}
+	}
+	if _, err = os.Stat(legacy2 + ".dat"); !os.IsNotExist(err) {
+		t.Errorf("legacy file left")
+	}
+}
+
+func TestFileBackendExpire(t *testing.T) {
+	expire := filepath.Join(t.TempDir(), "expire")
+	fb, err := NewFileBackend(expire, nil)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer fb.Close()
+	fb.maxAge = 10 * time.Millisecond
+
+	err = fb.Write([]byte("aaaa"))
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// nobody writes or reads, the record ages out all the same.
+	err = fb.Expire()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if fb.IsData() || fb.totalSize() != 0 {
+		t.Errorf("expired record left, %d bytes", fb.totalSize())
+	}
+}
+
+func TestFileBackendCorruption(t *testing.T) {
+	corrupt := filepath.Join(t.TempDir(), "corrupt")
+	fb, err := NewFileBackend(corrupt, nil)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	for _, s := range []string{"aaaa", "bbbb", "cccc"} {
+		err = fb.Write([]byte(s))
+		if err != nil {
+			t.Fatalf("error: %s", err)
+		}
+	}
+	fb.Close()
+
+	// flip a byte of bbbb, and tear a record at the end.
+	name := fb.segmentName(0)
+	p, _ := ioutil.ReadFile(name)
+	p[headerSize+20+16] = 'x'
+	p = append(p, 0, 0, 0, 9, 1, 2)
+	_ = ioutil.WriteFile(name, p, 0644)
+
+	fb, err = NewFileBackend(corrupt, nil)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer fb.Close()
+	if fb.totalSize() != headerSize+3*20 {
+		t.Errorf("torn record not truncated: %d bytes", fb.totalSize())
+	}
+	for _, s := range []string{"aaaa", "cccc"} {
+		p, err := fb.Read()
+		if err != nil || string(p) != s {
+			t.Fatalf("read %q %v, want %q", p, err, s)
+		}
+	}
+	p, err = fb.Read()
+	if p != nil || err != nil {
+		t.Errorf("read %q %v past the end", p, err)
+	}
+
+	quarantined, _ := ioutil.ReadFile(corrupt + ".corrupt")
+	if !bytes.HasSuffix(quarantined, []byte("xbbb")) {
+		t.Errorf("quarantined %q", quarantined)
+	}
+}
@@ -0,0 +1,14 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"os"
+)
+
+// flock doesn't lock on windows.
+func flock(file *os.File) error {
+	return nil
+}
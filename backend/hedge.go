@@ -0,0 +1,167 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// hedgeRace lets the first replica to answer write the response.
+type hedgeRace struct {
+	lock     sync.Mutex
+	w        http.ResponseWriter
+	winner   *hedgeWriter
+	attempts []*hedgeWriter
+}
+
+func (hr *hedgeRace) decided() bool {
+	hr.lock.Lock()
+	defer hr.lock.Unlock()
+	return hr.winner != nil
+}
+
+// hedgeWriter is the response writer of one replica of a hedged query. It
+// writes through once it has won, or else buffers the answer.
+type hedgeWriter struct {
+	*responseBuffer
+	race   *hedgeRace
+	cancel context.CancelFunc
+	won    bool
+}
+
+// WriteHeader wins the race with anything but a server error, and cancels
+// the other replicas.
+func (hw *hedgeWriter) WriteHeader(code int) {
+	hw.responseBuffer.WriteHeader(code)
+	if code/100 == 5 {
+		return
+	}
+
+	race := hw.race
+	race.lock.Lock()
+	defer race.lock.Unlock()
+	if race.winner != nil {
+		return
+	}
+	race.winner, hw.won = hw, true
+	for _, other := range race.attempts {
+		if other != hw {
+			other.cancel()
+		}
+	}
+	copyHeader(race.w.Header(), hw.header)
+	race.w.WriteHeader(code)
+}
+
+func (hw *hedgeWriter) Write(p []byte) (n int, err error) {
+	if hw.status == 0 {
+		hw.WriteHeader(200)
+	}
+	if hw.won {
+		return hw.race.w.Write(p)
+	}
+	return hw.responseBuffer.Write(p)
+}
+
+func (hw *hedgeWriter) Flush() {
+	if !hw.won {
+		return
+	}
+	if flusher, ok := hw.race.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+type hedgeAttempt struct {
+	hw  *hedgeWriter
+	err error
+}
+
+// queryHedged asks the replicas in turn like queryReplicas does, but asks
+// the next one too if the first hasn't answered within delay, or at once
+// if race. The first answer wins, the other queries are cancelled.
+func (ic *InfluxCluster) queryHedged(w http.ResponseWriter, req *http.Request, apis []BackendApi, delay time.Duration, race bool) (err error) {
+	hr := &hedgeRace{w: w}
+	attempts := make(chan *hedgeAttempt, len(apis))
+	next, running, hedged := 0, 0, false
+	start := func() {
+		ctx, cancel := context.WithCancel(req.Context())
+		hw := &hedgeWriter{responseBuffer: newResponseBuffer(), race: hr, cancel: cancel}
+		r := req.Clone(ctx)
+		r.Body = nil
+		r.Form = make(url.Values, len(req.Form))
+		for k, v := range req.Form {
+			r.Form[k] = append([]string(nil), v...)
+		}
+
+		hr.lock.Lock()
+		hr.attempts = append(hr.attempts, hw)
+		hr.lock.Unlock()
+		api := apis[next]
+		next++
+		running++
+		go func() {
+			err := api.Query(hw, r)
+			attempts <- &hedgeAttempt{hw: hw, err: err}
+		}()
+	}
+	defer func() {
+		hr.lock.Lock()
+		defer hr.lock.Unlock()
+		for _, hw := range hr.attempts {
+			hw.cancel()
+		}
+	}()
+
+	err = ErrQueryFailed
+	if len(apis) == 0 {
+		return
+	}
+	start()
+	if race && next < len(apis) {
+		start()
+		hedged = true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var failed *hedgeWriter
+	for running > 0 {
+		select {
+		case a := <-attempts:
+			running--
+			if a.hw.won {
+				return a.err
+			}
+			if hr.decided() {
+				// lost, wait for the winner.
+				continue
+			}
+			err = a.err
+			if failed == nil && a.hw.status != 0 {
+				failed = a.hw
+			}
+			if next < len(apis) {
+				start()
+			}
+
+		case <-timer.C:
+			if !hedged && next < len(apis) {
+				start()
+				hedged = true
+			}
+		}
+	}
+
+	// every replica failed, pass the first server error through.
+	if failed != nil {
+		return failed.WriteTo(w)
+	}
+	return
+}
@@ -0,0 +1,126 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// createHedgeCluster makes a cluster of two replicas of cpu, answering with
+// the handlers given.
+func createHedgeCluster(t *testing.T, slow, fast http.HandlerFunc) (ic *InfluxCluster, apis []BackendApi, closeAll func()) {
+	cfg1, ts1 := CreateTestBackendConfig(t, "slow")
+	ts1.Config.Handler = slow
+	cfg2, ts2 := CreateTestBackendConfig(t, "fast")
+	ts2.Config.Handler = fast
+	config := &Config{
+		Proxy:    ProxyConfig{DataDir: t.TempDir()},
+		Backends: map[string]BackendConfig{"slow": *cfg1, "fast": *cfg2},
+		Keymaps:  map[string][]string{"cpu": {"slow", "fast"}},
+	}
+	ic = NewInfluxCluster(config)
+	err := ic.Init()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	// the slow one is asked first.
+	apis = []BackendApi{ic.backends["slow"], ic.backends["fast"]}
+	return ic, apis, func() {
+		ic.Close()
+		ts1.Close()
+		ts2.Close()
+	}
+}
+
+func hedgeQuery(t *testing.T, ic *InfluxCluster, apis []BackendApi) (w *httptest.ResponseRecorder, elapsed time.Duration) {
+	req, _ := http.NewRequest("GET", "http://localhost:8086/query?q=select+*+from+cpu", nil)
+	_ = req.ParseForm()
+	w = httptest.NewRecorder()
+	start := time.Now()
+	err := ic.queryReplicas(w, req, apis)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	return w, time.Since(start)
+}
+
+func TestQueryHedged(t *testing.T) {
+	cancelled := make(chan struct{}, 2)
+	hung := func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/query" {
+			HandlerAny(w, req)
+			return
+		}
+		<-req.Context().Done()
+		cancelled <- struct{}{}
+	}
+	answer := func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/query" {
+			HandlerAny(w, req)
+			return
+		}
+		_, _ = w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+	}
+	ic, apis, closeAll := createHedgeCluster(t, hung, answer)
+	defer closeAll()
+
+	ic.QueryHedgeDelay = 50
+	w, elapsed := hedgeQuery(t, ic, apis)
+	if w.Code != 200 || w.Body.String() != `{"results":[{"statement_id":0}]}` {
+		t.Errorf("got %d %q", w.Code, w.Body.String())
+	}
+	if elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Errorf("answered in %s, want after the hedge delay", elapsed)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Errorf("slow query not cancelled")
+	}
+	if !apis[0].IsActive() {
+		t.Errorf("cancelled replica made inactive")
+	}
+
+	ic.QueryHedgeDelay, ic.QueryRace = 0, 1
+	w, elapsed = hedgeQuery(t, ic, apis)
+	if w.Code != 200 || elapsed > time.Second {
+		t.Errorf("race answered %d in %s", w.Code, elapsed)
+	}
+}
+
+func TestQueryHedgedFailover(t *testing.T) {
+	failing := func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/query" {
+			HandlerAny(w, req)
+			return
+		}
+		w.WriteHeader(500)
+		_, _ = w.Write([]byte(`{"error":"boom"}`))
+	}
+	answer := func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/query" {
+			HandlerAny(w, req)
+			return
+		}
+		_, _ = w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+	}
+	ic, apis, closeAll := createHedgeCluster(t, failing, answer)
+	defer closeAll()
+
+	ic.QueryHedgeDelay = 1000
+	w, elapsed := hedgeQuery(t, ic, apis)
+	if w.Code != 200 || elapsed > 500*time.Millisecond {
+		t.Errorf("got %d in %s, want the next replica at once", w.Code, elapsed)
+	}
+
+	// the server error passes through if every replica fails.
+	w, _ = hedgeQuery(t, ic, apis[:1])
+	if w.Code != 500 || w.Body.String() != `{"error":"boom"}` {
+		t.Errorf("got %d %q", w.Code, w.Body.String())
+	}
+}
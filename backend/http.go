@@ -7,6 +7,8 @@ package backend
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"encoding/json"
 	"errors"
 	"io"
 	"io/ioutil"
@@ -14,6 +16,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,8 +24,34 @@ var (
 	ErrBadRequest = errors.New("Bad Request")
 	ErrNotFound   = errors.New("Not Found")
 	ErrUnknown    = errors.New("Unknown Error")
+	// the answer of a backend broke off once passed on, so no other
+	// replica may be asked.
+	ErrResponseInterrupted = errors.New("response interrupted")
+	ErrQueryTimeout        = errors.New("query timeout")
 )
 
+type queryTimeoutKey struct{}
+
+// WithQueryTimeout overrides the query timeout of the backends for the
+// queries made with ctx, 0 for no limit.
+func WithQueryTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, queryTimeoutKey{}, timeout)
+}
+
+func queryTimeout(ctx context.Context) (timeout time.Duration, ok bool) {
+	timeout, ok = ctx.Value(queryTimeoutKey{}).(time.Duration)
+	return
+}
+
+func Decompress(p []byte) (data []byte, err error) {
+	zip, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return
+	}
+	defer zip.Close()
+	return ioutil.ReadAll(zip)
+}
+
 func Compress(buf *bytes.Buffer, p []byte) (err error) {
 	zip := gzip.NewWriter(buf)
 	n, err := zip.Write(p)
@@ -38,15 +67,18 @@ func Compress(buf *bytes.Buffer, p []byte) (err error) {
 }
 
 type HttpBackend struct {
-	client    *http.Client
-	transport http.Transport
-	Interval  int
-	URL       string
-	DB        string
-	Zone      string
-	Active    bool
-	running   bool
-	WriteOnly int
+	client       *http.Client
+	transport    http.Transport
+	timeoutQuery time.Duration
+	Interval     int
+	URL          string
+	DB           string
+	Zone         string
+	active       int32
+	running      int32
+	WriteOnly    int
+	Username     string
+	password     string
 }
 
 func NewHttpBackend(cfg *BackendConfig) (hb *HttpBackend) {
@@ -54,17 +86,16 @@ func NewHttpBackend(cfg *BackendConfig) (hb *HttpBackend) {
 		client: &http.Client{
 			Timeout: time.Millisecond * time.Duration(cfg.Timeout),
 		},
-		// TODO: query timeout? use req.Cancel
-		// client_query: &http.Client{
-		// 	Timeout: time.Millisecond * time.Duration(cfg.TimeoutQuery),
-		// },
-		Interval:  cfg.CheckInterval,
-		URL:       cfg.URL,
-		DB:        cfg.DB,
-		Zone:      cfg.Zone,
-		Active:    true,
-		running:   true,
-		WriteOnly: cfg.WriteOnly,
+		timeoutQuery: time.Millisecond * time.Duration(cfg.TimeoutQuery),
+		Interval:     cfg.CheckInterval,
+		URL:          cfg.URL,
+		DB:           cfg.DB,
+		Zone:         cfg.Zone,
+		active:       1,
+		running:      1,
+		WriteOnly:    cfg.WriteOnly,
+		Username:     cfg.Username,
+		password:     cfg.Password,
 	}
 	go hb.CheckActive()
 	return
@@ -74,9 +105,9 @@ func NewHttpBackend(cfg *BackendConfig) (hb *HttpBackend) {
 
 func (hb *HttpBackend) CheckActive() {
 	var err error
-	for hb.running {
+	for atomic.LoadInt32(&hb.running) != 0 {
 		_, err = hb.Ping()
-		hb.Active = err == nil
+		hb.setActive(err == nil)
 		time.Sleep(time.Millisecond * time.Duration(hb.Interval))
 	}
 }
@@ -89,11 +120,40 @@ func (hb *HttpBackend) IsWriteOnly() bool {
 }
 
 func (hb *HttpBackend) IsActive() bool {
-	return hb.Active
+	return atomic.LoadInt32(&hb.active) != 0
+}
+
+func (hb *HttpBackend) setActive(active bool) {
+	var v int32
+	if active {
+		v = 1
+	}
+	atomic.StoreInt32(&hb.active, v)
+}
+
+// database is the backend's own database if it has one, db otherwise.
+func (hb *HttpBackend) database(db string) string {
+	if hb.DB != "" {
+		return hb.DB
+	}
+	return db
+}
+
+// setAuth adds the backend's own credentials, if any.
+func (hb *HttpBackend) setAuth(req *http.Request) {
+	if hb.Username != "" {
+		req.SetBasicAuth(hb.Username, hb.password)
+	}
 }
 
 func (hb *HttpBackend) Ping() (version string, err error) {
-	resp, err := hb.client.Get(hb.URL + "/ping")
+	req, err := http.NewRequest("GET", hb.URL+"/ping", nil)
+	if err != nil {
+		return
+	}
+	hb.setAuth(req)
+
+	resp, err := hb.client.Do(req)
 	if err != nil {
 		log.Print("http error: ", err)
 		return
@@ -130,11 +190,18 @@ func (hb *HttpBackend) GetZone() (zone string) {
 // Don't setup Accept-Encoding: gzip. Let real client do so.
 // If real client don't support gzip and we setted, it will be a mistake.
 func (hb *HttpBackend) Query(w http.ResponseWriter, req *http.Request) (err error) {
-	if len(req.Form) == 0 {
-		req.Form = url.Values{}
+	// the request may be tried on other replicas after this one, which
+	// mustn't get its database.
+	form := make(url.Values, len(req.Form))
+	for k, v := range req.Form {
+		form[k] = append([]string(nil), v...)
 	}
-	req.Form.Set("db", hb.DB)
+	form.Set("db", hb.database(form.Get("db")))
+	req = req.Clone(req.Context())
+	req.Form = form
 	req.ContentLength = 0
+	StripCredentials(req)
+	hb.setAuth(req)
 
 	req.URL, err = url.Parse(hb.URL + "/query?" + req.Form.Encode())
 	if err != nil {
@@ -142,28 +209,68 @@ func (hb *HttpBackend) Query(w http.ResponseWriter, req *http.Request) (err erro
 		return
 	}
 
+	// the query lives as long as the request of the client, or less.
+	timeout := hb.timeoutQuery
+	if d, ok := queryTimeout(req.Context()); ok {
+		timeout = d
+	}
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
 	q := strings.TrimSpace(req.FormValue("q"))
 	resp, err := hb.transport.RoundTrip(req)
 	if err != nil {
 		log.Printf("query error: %s,the query is %s\n", err, q)
-		hb.Active = false
+		switch req.Context().Err() {
+		case context.DeadlineExceeded:
+			return ErrQueryTimeout
+		case nil:
+			hb.setActive(false)
+		}
+		// a query cancelled by the client or a hedge says nothing of us.
 		return
 	}
 	defer resp.Body.Close()
 
 	copyHeader(w.Header(), resp.Header)
-
-	p, err := ioutil.ReadAll(resp.Body)
+	w.WriteHeader(resp.StatusCode)
+	err = copyFlush(w, resp.Body)
 	if err != nil {
 		log.Printf("read body error: %s,the query is %s\n", err, q)
-		return
+		return ErrResponseInterrupted
 	}
-
-	w.WriteHeader(resp.StatusCode)
-	_, err = w.Write(p)
 	return
 }
 
+// copyFlush copies r to w, flushing w after each read so that a chunked
+// answer reaches the client as it comes.
+func copyFlush(w http.ResponseWriter, r io.Reader) (err error) {
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			_, err = w.Write(buf[:n])
+			if err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		switch rerr {
+		case nil:
+		case io.EOF:
+			return nil
+		default:
+			return rerr
+		}
+	}
+}
+
 func (hb *HttpBackend) Write(p []byte) (err error) {
 	var buf bytes.Buffer
 	err = Compress(&buf, p)
@@ -173,29 +280,34 @@ func (hb *HttpBackend) Write(p []byte) (err error) {
 	}
 
 	log.Printf("http backend write %s", hb.DB)
-	err = hb.WriteStream(&buf, true)
+	err = hb.WriteStream(&buf, true, BatchKey{})
 	return
 }
 
-func (hb *HttpBackend) WriteCompressed(p []byte) (err error) {
+func (hb *HttpBackend) WriteCompressed(p []byte, key BatchKey) (err error) {
 	buf := bytes.NewBuffer(p)
-	err = hb.WriteStream(buf, true)
+	err = hb.WriteStream(buf, true, key)
 	return
 }
 
-func (hb *HttpBackend) WriteStream(stream io.Reader, compressed bool) (err error) {
-	q := url.Values{}
-	q.Set("db", hb.DB)
+func (hb *HttpBackend) WriteStream(stream io.Reader, compressed bool, key BatchKey) (err error) {
+	q := key.Values()
+	q.Set("db", hb.database(key.DB))
 
 	req, err := http.NewRequest("POST", hb.URL+"/write?"+q.Encode(), stream)
-	if compressed && req != nil {
+	if err != nil {
+		log.Print("new request error: ", err)
+		return
+	}
+	if compressed {
 		req.Header.Add("Content-Encoding", "gzip")
 	}
+	hb.setAuth(req)
 
 	resp, err := hb.client.Do(req)
 	if err != nil {
 		log.Print("http error: ", err)
-		hb.Active = false
+		hb.setActive(false)
 		return
 	}
 	defer resp.Body.Close()
@@ -216,9 +328,9 @@ func (hb *HttpBackend) WriteStream(stream io.Reader, compressed bool) (err error
 	// https://docs.influxdata.com/influxdb/v1.1/tools/api/#write
 	switch resp.StatusCode {
 	case 400:
-		err = ErrBadRequest
+		err = newStatusError(ErrBadRequest, respbuf)
 	case 404:
-		err = ErrNotFound
+		err = newStatusError(ErrNotFound, respbuf)
 	default: // mostly tcp connection timeout
 		log.Printf("status: %d", resp.StatusCode)
 		err = ErrUnknown
@@ -226,8 +338,34 @@ func (hb *HttpBackend) WriteStream(stream io.Reader, compressed bool) (err error
 	return
 }
 
+// StatusError is a write refused by InfluxDB. It unwraps to ErrBadRequest
+// or ErrNotFound, and tells the error message of InfluxDB.
+type StatusError struct {
+	Err     error
+	Message string
+}
+
+func newStatusError(err error, body []byte) *StatusError {
+	var resp Response
+	if json.Unmarshal(body, &resp) == nil && resp.Err != "" {
+		return &StatusError{Err: err, Message: resp.Err}
+	}
+	return &StatusError{Err: err, Message: strings.TrimSpace(string(body))}
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return e.Err.Error()
+	}
+	return e.Err.Error() + ": " + e.Message
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
 func (hb *HttpBackend) Close() (err error) {
-	hb.running = false
+	atomic.StoreInt32(&hb.running, 0)
 	hb.transport.CloseIdleConnections()
 	return
 }
@@ -6,11 +6,14 @@ package backend
 
 import (
 	"bytes"
+	"context"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sync"
 	"testing"
+	"time"
 )
 
 func HandlerAny(w http.ResponseWriter, req *http.Request) {
@@ -21,7 +24,7 @@ func HandlerAny(w http.ResponseWriter, req *http.Request) {
 	return
 }
 
-func CreateTestBackendConfig(dbname string) (cfg *BackendConfig, ts *httptest.Server) {
+func CreateTestBackendConfig(t *testing.T, dbname string) (cfg *BackendConfig, ts *httptest.Server) {
 	ts = httptest.NewServer(http.HandlerFunc(HandlerAny))
 	cfg = &BackendConfig{
 		URL:             ts.URL,
@@ -32,12 +35,13 @@ func CreateTestBackendConfig(dbname string) (cfg *BackendConfig, ts *httptest.Se
 		MaxRowLimit:     1000,
 		CheckInterval:   1000,
 		RewriteInterval: 1000,
+		DataDir:         t.TempDir(),
 	}
 	return
 }
 
 func TestHttpBackendWrite(t *testing.T) {
-	cfg, ts := CreateTestBackendConfig("test")
+	cfg, ts := CreateTestBackendConfig(t, "test")
 	defer ts.Close()
 	hb := NewHttpBackend(cfg)
 	defer hb.Close()
@@ -50,7 +54,7 @@ func TestHttpBackendWrite(t *testing.T) {
 }
 
 func TestHttpBackendWriteCompressed(t *testing.T) {
-	cfg, ts := CreateTestBackendConfig("test")
+	cfg, ts := CreateTestBackendConfig(t, "test")
 	defer ts.Close()
 	hb := NewHttpBackend(cfg)
 	defer hb.Close()
@@ -63,14 +67,14 @@ func TestHttpBackendWriteCompressed(t *testing.T) {
 		return
 	}
 	p = buf.Bytes()
-	err = hb.WriteCompressed(p)
+	err = hb.WriteCompressed(p, BatchKey{})
 	if err != nil {
 		t.Errorf("error: %s", err)
 		return
 	}
 }
 func TestHttpBackendPing(t *testing.T) {
-	cfg, ts := CreateTestBackendConfig("test")
+	cfg, ts := CreateTestBackendConfig(t, "test")
 	defer ts.Close()
 	hb := NewHttpBackend(cfg)
 	defer hb.Close()
@@ -114,7 +118,7 @@ func (drw *DummyResponseWriter) WriteHeader(code int) {
 }
 
 func TestHttpBackendQuery(t *testing.T) {
-	cfg, ts := CreateTestBackendConfig("test")
+	cfg, ts := CreateTestBackendConfig(t, "test")
 	defer ts.Close()
 	hb := NewHttpBackend(cfg)
 	defer hb.Close()
@@ -142,3 +146,175 @@ func TestHttpBackendQuery(t *testing.T) {
 		return
 	}
 }
+
+func TestHttpBackendCredentials(t *testing.T) {
+	var lock sync.Mutex
+	var username, password string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer req.Body.Close()
+		if req.URL.Path == "/ping" {
+			w.WriteHeader(204)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		username, password, _ = req.BasicAuth()
+		if req.URL.Query().Get("u") != "" {
+			username = "leaked"
+		}
+		w.WriteHeader(204)
+	}))
+	defer ts.Close()
+	cfg := &BackendConfig{
+		URL:      ts.URL,
+		DB:       "test",
+		Username: "proxy",
+		Password: "secret",
+	}
+	hb := NewHttpBackend(cfg)
+	defer hb.Close()
+
+	err := hb.Write([]byte("cpu value=1"))
+	lock.Lock()
+	if err != nil || username != "proxy" || password != "secret" {
+		t.Errorf("write credentials: %s %s %v", username, password, err)
+	}
+	lock.Unlock()
+
+	req, _ := http.NewRequest("GET", ts.URL+"/query?q=select+*+from+cpu&u=client&p=client", nil)
+	req.SetBasicAuth("client", "client")
+	_ = req.ParseForm()
+	err = hb.Query(NewDummyResponseWriter(), req)
+	lock.Lock()
+	defer lock.Unlock()
+	if err != nil || username != "proxy" || password != "secret" {
+		t.Errorf("query credentials: %s %s %v", username, password, err)
+	}
+}
+
+func TestHttpBackendQueryDatabase(t *testing.T) {
+	dbs := make(chan string, 2)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/query" {
+			HandlerAny(w, req)
+			return
+		}
+		dbs <- req.FormValue("db")
+		w.WriteHeader(204)
+	})
+	ts1 := httptest.NewServer(handler)
+	defer ts1.Close()
+	ts2 := httptest.NewServer(handler)
+	defer ts2.Close()
+	hb1 := NewHttpBackend(&BackendConfig{URL: ts1.URL, DB: "own", CheckInterval: 1000})
+	defer hb1.Close()
+	hb2 := NewHttpBackend(&BackendConfig{URL: ts2.URL, CheckInterval: 1000})
+	defer hb2.Close()
+
+	// the replicas are asked in turn with the same request.
+	req, _ := http.NewRequest("GET", "http://localhost:8086/query?q=select+*+from+cpu&db=client", nil)
+	_ = req.ParseForm()
+	for _, hb := range []*HttpBackend{hb1, hb2} {
+		err := hb.Query(NewDummyResponseWriter(), req)
+		if err != nil {
+			t.Fatalf("error: %s", err)
+		}
+	}
+	if db1, db2 := <-dbs, <-dbs; db1 != "own" || db2 != "client" {
+		t.Errorf("asked %s and %s", db1, db2)
+	}
+	if db := req.Form.Get("db"); db != "client" {
+		t.Errorf("request changed to %s", db)
+	}
+}
+
+// flushRecorder tells each flush of the response.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes chan string
+}
+
+func (fr *flushRecorder) Flush() {
+	fr.flushes <- fr.Body.String()
+}
+
+func TestHttpBackendQueryStream(t *testing.T) {
+	next := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(200)
+		_, _ = w.Write([]byte("chunk1\n"))
+		w.(http.Flusher).Flush()
+		<-next
+		_, _ = w.Write([]byte("chunk2\n"))
+	}))
+	defer ts.Close()
+	hb := NewHttpBackend(&BackendConfig{URL: ts.URL, DB: "test", Timeout: 1000})
+	defer hb.Close()
+
+	req, _ := http.NewRequest("GET", ts.URL+"/query?q=select+*+from+cpu", nil)
+	_ = req.ParseForm()
+	w := &flushRecorder{httptest.NewRecorder(), make(chan string, 2)}
+	done := make(chan error, 1)
+	go func() {
+		done <- hb.Query(w, req)
+	}()
+
+	// the first chunk comes through before the backend sends the next.
+	if body := <-w.flushes; body != "chunk1\n" {
+		t.Errorf("flushed %q, want the first chunk", body)
+	}
+	close(next)
+	if err := <-done; err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if w.Body.String() != "chunk1\nchunk2\n" {
+		t.Errorf("got %q", w.Body.String())
+	}
+}
+
+func TestHttpBackendQueryTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/query" {
+			HandlerAny(w, req)
+			return
+		}
+		<-req.Context().Done()
+	}))
+	defer ts.Close()
+	hb := NewHttpBackend(&BackendConfig{URL: ts.URL, DB: "test", Timeout: 1000, TimeoutQuery: 50})
+	defer hb.Close()
+
+	query := func(ctx context.Context) (elapsed time.Duration, err error) {
+		req, _ := http.NewRequest("GET", ts.URL+"/query?q=select+*+from+cpu", nil)
+		_ = req.ParseForm()
+		start := time.Now()
+		err = hb.Query(NewDummyResponseWriter(), req.WithContext(ctx))
+		return time.Since(start), err
+	}
+
+	elapsed, err := query(context.Background())
+	if err != ErrQueryTimeout || elapsed > time.Second {
+		t.Errorf("got %v in %s, want a timeout", err, elapsed)
+	}
+
+	// a request may wait less, or more.
+	elapsed, err = query(WithQueryTimeout(context.Background(), 10*time.Millisecond))
+	if err != ErrQueryTimeout || elapsed >= 50*time.Millisecond {
+		t.Errorf("got %v in %s, want a timeout sooner", err, elapsed)
+	}
+	elapsed, err = query(WithQueryTimeout(context.Background(), 100*time.Millisecond))
+	if err != ErrQueryTimeout || elapsed < 100*time.Millisecond {
+		t.Errorf("got %v in %s, want a timeout later", err, elapsed)
+	}
+
+	// the client going away cancels the query.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	elapsed, err = query(WithQueryTimeout(ctx, 0))
+	if err == nil || err == ErrQueryTimeout || elapsed > time.Second {
+		t.Errorf("got %v in %s, want the query cancelled", err, elapsed)
+	}
+	if !hb.IsActive() {
+		t.Errorf("backend made inactive by a slow query")
+	}
+}
@@ -97,3 +97,135 @@ func GetMeasurementsFromInfluxQL(q string) (m []string, err error) {
 
 	return m, ErrIllegalQL
 }
+
+// GetConditionFromInfluxQL returns the WHERE clause, nil if there is none.
+func GetConditionFromInfluxQL(q string) (cond influxql.Expr, err error) {
+	stmt, err := influxql.ParseStatement(q)
+	if err != nil {
+		return
+	}
+	switch s := stmt.(type) {
+	case *influxql.SelectStatement:
+		cond = s.Condition
+	case *influxql.ShowSeriesStatement:
+		cond = s.Condition
+	case *influxql.ShowTagKeysStatement:
+		cond = s.Condition
+	case *influxql.ShowTagValuesStatement:
+		cond = s.Condition
+	case *influxql.DeleteStatement:
+		cond = s.Condition
+	case *influxql.DeleteSeriesStatement:
+		cond = s.Condition
+	}
+	return
+}
+
+// GetSourcesFromStatement returns the FROM clause of statements reading a
+// list of sources.
+func GetSourcesFromStatement(stmt influxql.Statement) (sources influxql.Sources, ok bool) {
+	switch s := stmt.(type) {
+	case *influxql.SelectStatement:
+		return s.Sources, true
+	case *influxql.ShowFieldKeysStatement:
+		return s.Sources, true
+	case *influxql.ShowSeriesStatement:
+		return s.Sources, true
+	case *influxql.ShowTagKeysStatement:
+		return s.Sources, true
+	case *influxql.ShowTagValuesStatement:
+		return s.Sources, true
+	case *influxql.DeleteSeriesStatement:
+		return s.Sources, true
+	}
+	return nil, false
+}
+
+func SetSourcesOfStatement(stmt influxql.Statement, sources influxql.Sources) {
+	switch s := stmt.(type) {
+	case *influxql.SelectStatement:
+		s.Sources = sources
+	case *influxql.ShowFieldKeysStatement:
+		s.Sources = sources
+	case *influxql.ShowSeriesStatement:
+		s.Sources = sources
+	case *influxql.ShowTagKeysStatement:
+		s.Sources = sources
+	case *influxql.ShowTagValuesStatement:
+		s.Sources = sources
+	case *influxql.DeleteSeriesStatement:
+		s.Sources = sources
+	}
+}
+
+// IsMultiSource tells whether sources can't be routed as one measurement.
+func IsMultiSource(sources influxql.Sources) bool {
+	if len(sources) > 1 {
+		return true
+	}
+	for _, source := range sources {
+		switch s := source.(type) {
+		case *influxql.Measurement:
+			if s.Regex != nil {
+				return true
+			}
+		case *influxql.SubQuery:
+			return true
+		}
+	}
+	return false
+}
+
+// IsDatabaseStatement tells SHOW statements about the whole database, those
+// with no FROM clause.
+func IsDatabaseStatement(stmt influxql.Statement) bool {
+	switch s := stmt.(type) {
+	case *influxql.ShowDatabasesStatement, *influxql.ShowRetentionPoliciesStatement, *influxql.ShowMeasurementsStatement:
+		return true
+	case *influxql.ShowTagKeysStatement:
+		return len(s.Sources) == 0
+	case *influxql.ShowTagValuesStatement:
+		return len(s.Sources) == 0
+	case *influxql.ShowFieldKeysStatement:
+		return len(s.Sources) == 0
+	case *influxql.ShowSeriesStatement:
+		return len(s.Sources) == 0
+	}
+	return false
+}
+
+// GetDatabaseOfStatement returns the database of the ON clause.
+func GetDatabaseOfStatement(stmt influxql.Statement) (db string) {
+	switch s := stmt.(type) {
+	case *influxql.ShowRetentionPoliciesStatement:
+		return s.Database
+	case *influxql.ShowMeasurementsStatement:
+		return s.Database
+	case *influxql.ShowTagKeysStatement:
+		return s.Database
+	case *influxql.ShowTagValuesStatement:
+		return s.Database
+	case *influxql.ShowFieldKeysStatement:
+		return s.Database
+	case *influxql.ShowSeriesStatement:
+		return s.Database
+	}
+	return
+}
+
+func SetDatabaseOfStatement(stmt influxql.Statement, db string) {
+	switch s := stmt.(type) {
+	case *influxql.ShowRetentionPoliciesStatement:
+		s.Database = db
+	case *influxql.ShowMeasurementsStatement:
+		s.Database = db
+	case *influxql.ShowTagKeysStatement:
+		s.Database = db
+	case *influxql.ShowTagValuesStatement:
+		s.Database = db
+	case *influxql.ShowFieldKeysStatement:
+		s.Database = db
+	case *influxql.ShowSeriesStatement:
+		s.Database = db
+	}
+}
@@ -7,6 +7,8 @@ package backend
 import (
 	"fmt"
 	"testing"
+
+	"github.com/influxdata/influxql"
 )
 
 // SHOW USERS
@@ -108,3 +110,31 @@ func BenchmarkInfluxQL(b *testing.B) {
 		}
 	}
 }
+
+func TestIsMultiSource(t *testing.T) {
+	tests := []struct {
+		query string
+		multi bool
+	}{
+		{"SELECT * FROM cpu", false},
+		{"SELECT * FROM cpu, mem", true},
+		{"SELECT * FROM /cpu.*/", true},
+		{"SELECT mean(value) FROM (SELECT value FROM cpu)", true},
+		{"SHOW TAG KEYS FROM cpu, mem", true},
+	}
+	for _, tt := range tests {
+		stmt, err := influxql.ParseStatement(tt.query)
+		if err != nil {
+			t.Errorf("error: %s", err)
+			continue
+		}
+		sources, ok := GetSourcesFromStatement(stmt)
+		if !ok {
+			t.Errorf("no sources: %s", tt.query)
+			continue
+		}
+		if IsMultiSource(sources) != tt.multi {
+			t.Errorf("%s multi source: want %v", tt.query, tt.multi)
+		}
+	}
+}
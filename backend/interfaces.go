@@ -17,5 +17,8 @@ type BackendApi interface {
 	Ping() (version string, err error)
 	GetZone() (zone string)
 	Write(p []byte) (err error)
+	WriteKey(p []byte, key BatchKey) (err error)
+	WriteSync(p []byte, key BatchKey, ack chan<- error) (err error)
+	DeadLetters() (df *DeadLetterFile)
 	Close() (err error)
 }
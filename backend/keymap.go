@@ -0,0 +1,67 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+const (
+	RuleExact   = "exact"
+	RuleRegex   = "regex"
+	RuleGlob    = "glob"
+	RuleDefault = "default"
+	RuleShard   = "shard"
+)
+
+var (
+	ErrIllegalPatternType = errors.New("illegal keymap pattern type")
+)
+
+type patternRoute struct {
+	rule     *PatternKeymap
+	regexp   *regexp.Regexp
+	backends []BackendApi
+}
+
+// RouteMetadata tells which keymap rule a measurement is routed by.
+type RouteMetadata struct {
+	Database    string   `json:"database,omitempty"`
+	Measurement string   `json:"measurement"`
+	Type        string   `json:"type"`
+	Pattern     string   `json:"pattern,omitempty"`
+	Backends    []string `json:"backends"`
+}
+
+// GlobToRegexp translates a glob, where '*' matches any sequence and '?'
+// matches one character, to an anchored regexp.
+func GlobToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteByte('^')
+	for _, c := range glob {
+		switch c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteByte('.')
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteByte('$')
+	return b.String()
+}
+
+func CompilePattern(rule *PatternKeymap) (r *regexp.Regexp, err error) {
+	switch rule.Type {
+	case RuleRegex:
+		return regexp.Compile(rule.Pattern)
+	case RuleGlob:
+		return regexp.Compile(GlobToRegexp(rule.Pattern))
+	}
+	return nil, ErrIllegalPatternType
+}
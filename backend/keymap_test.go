@@ -0,0 +1,115 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob  string
+		name  string
+		match bool
+	}{
+		{"app.*.latency", "app.web.latency", true},
+		{"app.*.latency", "app.web.latency.p99", false},
+		{"app.*.latency", "appXweb.latency", false},
+		{"cpu?", "cpu1", true},
+		{"cpu?", "cpu", false},
+		{"*", "anything", true},
+	}
+	for _, tt := range tests {
+		r := regexp.MustCompile(GlobToRegexp(tt.glob))
+		if r.MatchString(tt.name) != tt.match {
+			t.Errorf("glob %s match %s: want %v", tt.glob, tt.name, tt.match)
+		}
+	}
+}
+
+func CreateTestPatternCluster(t *testing.T) (ic *InfluxCluster, err error) {
+	cfg1, _ := CreateTestBackendConfig(t, "test1")
+	cfg2, _ := CreateTestBackendConfig(t, "test2")
+	config := &Config{
+		Proxy: ProxyConfig{DataDir: t.TempDir()},
+		Backends: map[string]BackendConfig{
+			"test1": *cfg1,
+			"test2": *cfg2,
+		},
+		Keymaps: map[string][]string{
+			"app.db.latency": {"test2"},
+			"_default_":      {"test1", "test2"},
+		},
+		PatternKeymaps: []PatternKeymap{
+			{Type: RuleRegex, Pattern: "^app\\.web\\.", Backends: []string{"test2"}},
+			{Type: RuleGlob, Pattern: "app.*.latency", Backends: []string{"test1"}},
+		},
+	}
+	ic = NewInfluxCluster(config)
+	err = ic.Init()
+	return
+}
+
+func TestInfluxClusterPatternLookup(t *testing.T) {
+	ic, err := CreateTestPatternCluster(t)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ic.Close()
+
+	tests := []struct {
+		measurement string
+		rule        string
+		pattern     string
+		backends    int
+	}{
+		{"app.db.latency", RuleExact, "app.db.latency", 1},
+		{"app.web.latency", RuleRegex, "^app\\.web\\.", 1},
+		{"app.cache.latency", RuleGlob, "app.*.latency", 1},
+		{"cpu", RuleDefault, "", 2},
+	}
+	for _, tt := range tests {
+		route := ic.GetRoute(tt.measurement)
+		if route.Type != tt.rule || route.Pattern != tt.pattern {
+			t.Errorf("%s matched %s %s, want %s %s", tt.measurement, route.Type, route.Pattern, tt.rule, tt.pattern)
+		}
+		bs, ok := ic.GetBackends(tt.measurement)
+		if !ok || len(bs) != tt.backends {
+			t.Errorf("%s got %d backends, want %d", tt.measurement, len(bs), tt.backends)
+		}
+	}
+}
+
+func TestInfluxClusterIllegalPattern(t *testing.T) {
+	config := &Config{
+		Proxy: ProxyConfig{DataDir: t.TempDir()},
+		PatternKeymaps: []PatternKeymap{
+			{Type: "prefix", Pattern: "app.", Backends: []string{}},
+		},
+	}
+	ic := NewInfluxCluster(config)
+	err := ic.Init()
+	if err != ErrIllegalPatternType {
+		t.Errorf("want %s, got %v", ErrIllegalPatternType, err)
+	}
+}
+
+func TestInfluxClusterPatternUnknownBackend(t *testing.T) {
+	// a later pattern loading fine doesn't hide the error.
+	config := &Config{
+		Proxy: ProxyConfig{DataDir: t.TempDir()},
+		PatternKeymaps: []PatternKeymap{
+			{Type: "glob", Pattern: "app.*", Backends: []string{"missing"}},
+			{Type: "glob", Pattern: "sys.*", Backends: []string{}},
+		},
+	}
+	ic := NewInfluxCluster(config)
+	err := ic.Init()
+	if err != ErrBackendNotExist {
+		t.Errorf("want %s, got %v", ErrBackendNotExist, err)
+	}
+}
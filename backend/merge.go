@@ -0,0 +1,412 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// DefaultChunkSize is the rows of a chunk, when a chunked query doesn't
+// tell, as in InfluxDB.
+const DefaultChunkSize = 10000
+
+// Response is the JSON body of an InfluxDB /query response.
+type Response struct {
+	Results []*Result `json:"results,omitempty"`
+	Err     string    `json:"error,omitempty"`
+}
+
+type Result struct {
+	StatementID int           `json:"statement_id"`
+	Series      []*models.Row `json:"series,omitempty"`
+	Messages    []*Message    `json:"messages,omitempty"`
+	Partial     bool          `json:"partial,omitempty"`
+	Err         string        `json:"error,omitempty"`
+}
+
+type Message struct {
+	Level string `json:"level"`
+	Text  string `json:"text"`
+}
+
+// DecodeResponse reads one response, or a stream of chunked responses which
+// are merged into one.
+func DecodeResponse(r io.Reader) (resp *Response, err error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	resp = &Response{}
+	var tail *models.Row // a series the last chunk cut short
+	for {
+		chunk := &Response{}
+		err = dec.Decode(chunk)
+		if err == io.EOF {
+			return resp, nil
+		}
+		if err != nil {
+			return
+		}
+
+		// the rest of a series doesn't overlap what came before, no need
+		// to merge it row by row.
+		if tail != nil && len(chunk.Results) > 0 && len(chunk.Results[0].Series) > 0 {
+			head := chunk.Results[0].Series[0]
+			if head.Name == tail.Name && seriesTagsKey(head.Tags) == seriesTagsKey(tail.Tags) &&
+				sameColumns(head.Columns, tail.Columns) {
+				tail.Values = append(tail.Values, head.Values...)
+				tail.Partial = head.Partial
+				chunk.Results[0].Series = chunk.Results[0].Series[1:]
+			}
+		}
+		MergeResponse(resp, chunk)
+		tail = partialTail(resp, chunk, tail)
+	}
+}
+
+// partialTail finds in resp the series chunk ended with, if cut short. A
+// chunk which only continued tail leaves it as is.
+func partialTail(resp, chunk *Response, tail *models.Row) *models.Row {
+	n := len(chunk.Results)
+	if n == 0 {
+		return nil
+	}
+	result := chunk.Results[n-1]
+	if len(result.Series) == 0 {
+		if tail != nil && tail.Partial {
+			return tail
+		}
+		return nil
+	}
+	last := result.Series[len(result.Series)-1]
+	if !last.Partial {
+		return nil
+	}
+	for _, r := range resp.Results {
+		if r.StatementID != result.StatementID {
+			continue
+		}
+		for _, row := range r.Series {
+			if row.Name == last.Name && seriesTagsKey(row.Tags) == seriesTagsKey(last.Tags) {
+				row.Partial = true
+				return row
+			}
+		}
+	}
+	return nil
+}
+
+// MergeResponses merges results statement by statement.
+func MergeResponses(resps []*Response) (merged *Response) {
+	merged = &Response{}
+	for _, resp := range resps {
+		MergeResponse(merged, resp)
+	}
+	return
+}
+
+func MergeResponse(dst, src *Response) {
+	if dst.Err == "" {
+		dst.Err = src.Err
+	}
+	for _, result := range src.Results {
+		var target *Result
+		for _, r := range dst.Results {
+			if r.StatementID == result.StatementID {
+				target = r
+				break
+			}
+		}
+		if target == nil {
+			target = &Result{StatementID: result.StatementID}
+			dst.Results = append(dst.Results, target)
+		}
+		MergeResult(target, result)
+	}
+	sort.SliceStable(dst.Results, func(i, j int) bool {
+		return dst.Results[i].StatementID < dst.Results[j].StatementID
+	})
+}
+
+// MergeResult unions the series of src into dst. Series with the same name
+// and tags are joined, duplicate rows dropped and rows kept in time order.
+func MergeResult(dst, src *Result) {
+	if dst.Err == "" {
+		dst.Err = src.Err
+	}
+	dst.Messages = append(dst.Messages, src.Messages...)
+	for _, row := range src.Series {
+		var target *models.Row
+		for _, s := range dst.Series {
+			if s.Name == row.Name && seriesTagsKey(s.Tags) == seriesTagsKey(row.Tags) {
+				target = s
+				break
+			}
+		}
+		if target == nil {
+			target = &models.Row{Name: row.Name, Tags: row.Tags, Columns: row.Columns}
+			dst.Series = append(dst.Series, target)
+		}
+		mergeRow(target, row)
+	}
+	sort.SliceStable(dst.Series, func(i, j int) bool {
+		if dst.Series[i].Name != dst.Series[j].Name {
+			return dst.Series[i].Name < dst.Series[j].Name
+		}
+		return seriesTagsKey(dst.Series[i].Tags) < seriesTagsKey(dst.Series[j].Tags)
+	})
+}
+
+// Reverse turns rows of every series upside down, for ORDER BY time DESC.
+func (resp *Response) Reverse() {
+	for _, result := range resp.Results {
+		for _, row := range result.Series {
+			for i, j := 0, len(row.Values)-1; i < j; i, j = i+1, j-1 {
+				row.Values[i], row.Values[j] = row.Values[j], row.Values[i]
+			}
+		}
+	}
+}
+
+// DropColumns removes the named columns from every series.
+func (resp *Response) DropColumns(names []string) {
+	if len(names) == 0 {
+		return
+	}
+	for _, result := range resp.Results {
+		for _, row := range result.Series {
+			var columns []string
+			var keep []int
+			for i, c := range row.Columns {
+				if indexOf(names, c) < 0 {
+					columns = append(columns, c)
+					keep = append(keep, i)
+				}
+			}
+			for n, vv := range row.Values {
+				kept := make([]interface{}, 0, len(keep))
+				for _, i := range keep {
+					if i < len(vv) {
+						kept = append(kept, vv[i])
+					}
+				}
+				row.Values[n] = kept
+			}
+			row.Columns = columns
+		}
+	}
+}
+
+func seriesTagsKey(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(tags[k])
+		b.WriteByte(',')
+	}
+	return b.String()
+}
+
+// mergeRow keeps a row as many times as the answer with most of it does:
+// replicas hold copies of the same points, while a row repeated in one
+// answer is a point of each of several series.
+func mergeRow(dst, src *models.Row) {
+	alignColumns(dst, src)
+	counts := make(map[string]int, len(dst.Values))
+	for _, vv := range dst.Values {
+		if key, err := json.Marshal(vv); err == nil {
+			counts[string(key)]++
+		}
+	}
+	for _, vv := range src.Values {
+		if key, err := json.Marshal(vv); err == nil && counts[string(key)] > 0 {
+			counts[string(key)]--
+			continue
+		}
+		dst.Values = append(dst.Values, vv)
+	}
+	if len(dst.Columns) == 0 {
+		return
+	}
+	if dst.Columns[0] == "time" {
+		sort.SliceStable(dst.Values, func(i, j int) bool {
+			return lessTime(dst.Values[i][0], dst.Values[j][0])
+		})
+		return
+	}
+	// SHOW results, keyed by name
+	sort.SliceStable(dst.Values, func(i, j int) bool {
+		a, _ := dst.Values[i][0].(string)
+		b, _ := dst.Values[j][0].(string)
+		return a < b
+	})
+}
+
+// alignColumns makes dst and src share one column order, the union of both.
+func alignColumns(dst, src *models.Row) {
+	if sameColumns(dst.Columns, src.Columns) {
+		return
+	}
+	columns := append([]string{}, dst.Columns...)
+	for _, c := range src.Columns {
+		if indexOf(columns, c) < 0 {
+			columns = append(columns, c)
+		}
+	}
+	dst.Values = realign(dst.Values, dst.Columns, columns)
+	src.Values = realign(src.Values, src.Columns, columns)
+	dst.Columns = columns
+	src.Columns = columns
+}
+
+func realign(values [][]interface{}, from, to []string) (aligned [][]interface{}) {
+	for _, vv := range values {
+		row := make([]interface{}, len(to))
+		for i, c := range from {
+			if i < len(vv) {
+				row[indexOf(to, c)] = vv[i]
+			}
+		}
+		aligned = append(aligned, row)
+	}
+	return
+}
+
+func sameColumns(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func indexOf(s []string, v string) int {
+	for i := range s {
+		if s[i] == v {
+			return i
+		}
+	}
+	return -1
+}
+
+// lessTime compares epoch numbers or RFC3339 strings.
+func lessTime(a, b interface{}) bool {
+	switch ta := a.(type) {
+	case json.Number:
+		if tb, ok := b.(json.Number); ok {
+			ia, erra := ta.Int64()
+			ib, errb := tb.Int64()
+			if erra == nil && errb == nil {
+				return ia < ib
+			}
+			fa, _ := ta.Float64()
+			fb, _ := tb.Float64()
+			return fa < fb
+		}
+	case string:
+		if tb, ok := b.(string); ok {
+			pa, erra := time.Parse(time.RFC3339Nano, ta)
+			pb, errb := time.Parse(time.RFC3339Nano, tb)
+			if erra == nil && errb == nil {
+				return pa.Before(pb)
+			}
+			return ta < tb
+		}
+	}
+	return false
+}
+
+func WriteResponse(w http.ResponseWriter, status int, resp *Response) (err error) {
+	p, err := json.Marshal(resp)
+	if err != nil {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(append(p, '\n'))
+	return
+}
+
+// ChunkSize tells the rows a chunk of the answer to req holds, or 0 if req
+// didn't ask for a chunked answer.
+func ChunkSize(req *http.Request) int {
+	chunked, _ := strconv.ParseBool(req.FormValue("chunked"))
+	if !chunked {
+		return 0
+	}
+	size, err := strconv.Atoi(req.FormValue("chunk_size"))
+	if err != nil || size <= 0 {
+		return DefaultChunkSize
+	}
+	return size
+}
+
+// WriteChunkedResponse writes resp as InfluxDB does a chunked answer, a
+// response of at most size rows a chunk. A series cut short is partial,
+// as is a result more chunks of which follow.
+func WriteChunkedResponse(w http.ResponseWriter, resp *Response, size int) (err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	write := func(chunk *Response) error {
+		err := enc.Encode(chunk)
+		if err == nil && flusher != nil {
+			flusher.Flush()
+		}
+		return err
+	}
+	if resp.Err != "" {
+		return write(resp)
+	}
+
+	for _, result := range resp.Results {
+		chunk := &Result{StatementID: result.StatementID, Messages: result.Messages, Err: result.Err}
+		rows := 0
+		for _, row := range result.Series {
+			values := row.Values
+			for first := true; first || len(values) > 0; first = false {
+				if rows == size {
+					chunk.Partial = true
+					err = write(&Response{Results: []*Result{chunk}})
+					if err != nil {
+						return
+					}
+					chunk, rows = &Result{StatementID: result.StatementID}, 0
+				}
+				n := size - rows
+				if n > len(values) {
+					n = len(values)
+				}
+				part := *row
+				part.Values, values = values[:n], values[n:]
+				part.Partial = len(values) > 0
+				chunk.Series = append(chunk.Series, &part)
+				rows += n
+			}
+		}
+		err = write(&Response{Results: []*Result{chunk}})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,154 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func decodeTestResponse(t *testing.T, s string) (resp *Response) {
+	resp, err := DecodeResponse(strings.NewReader(s))
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	return
+}
+
+func TestMergeResponses(t *testing.T) {
+	a := decodeTestResponse(t, `{"results":[{"statement_id":0,"series":[
+		{"name":"cpu","tags":{"host":"a"},"columns":["time","value"],"values":[[1,1],[3,3]]},
+		{"name":"cpu","tags":{"host":"b"},"columns":["time","value"],"values":[[1,10]]}]}]}`)
+	b := decodeTestResponse(t, `{"results":[{"statement_id":0,"series":[
+		{"name":"cpu","tags":{"host":"a"},"columns":["time","value"],"values":[[2,2],[3,3]]},
+		{"name":"cpu","tags":{"host":"c"},"columns":["time","value"],"values":[[1,100]]}]}]}`)
+
+	merged := MergeResponses([]*Response{a, b})
+	p, err := json.Marshal(merged)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	want := `{"results":[{"statement_id":0,"series":[` +
+		`{"name":"cpu","tags":{"host":"a"},"columns":["time","value"],"values":[[1,1],[2,2],[3,3]]},` +
+		`{"name":"cpu","tags":{"host":"b"},"columns":["time","value"],"values":[[1,10]]},` +
+		`{"name":"cpu","tags":{"host":"c"},"columns":["time","value"],"values":[[1,100]]}]}]}`
+	if string(p) != want {
+		t.Errorf("merged:\n%s\nwant:\n%s", p, want)
+	}
+}
+
+func TestMergeColumns(t *testing.T) {
+	a := decodeTestResponse(t, `{"results":[{"statement_id":0,"series":[
+		{"name":"cpu","columns":["time","idle"],"values":[["2020-01-01T00:00:01Z",1]]}]}]}`)
+	b := decodeTestResponse(t, `{"results":[{"statement_id":0,"series":[
+		{"name":"cpu","columns":["time","user"],"values":[["2020-01-01T00:00:00.5Z",2]]}]}]}`)
+
+	merged := MergeResponses([]*Response{a, b})
+	p, _ := json.Marshal(merged)
+	want := `{"results":[{"statement_id":0,"series":[` +
+		`{"name":"cpu","columns":["time","idle","user"],"values":[["2020-01-01T00:00:00.5Z",null,2],["2020-01-01T00:00:01Z",1,null]]}]}]}`
+	if string(p) != want {
+		t.Errorf("merged:\n%s\nwant:\n%s", p, want)
+	}
+}
+
+func TestDecodeChunkedResponse(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[1,1]],"partial":true}],"partial":true}]}` + "\n")
+	buf.WriteString(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[2,2]]}]}]}` + "\n")
+
+	resp, err := DecodeResponse(&buf)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if len(resp.Results) != 1 || len(resp.Results[0].Series) != 1 {
+		t.Fatalf("chunks not merged: %+v", resp)
+	}
+	if len(resp.Results[0].Series[0].Values) != 2 {
+		t.Errorf("want 2 values, got %v", resp.Results[0].Series[0].Values)
+	}
+}
+
+func TestMergeShowResults(t *testing.T) {
+	a := decodeTestResponse(t, `{"results":[{"statement_id":0,"series":[
+		{"name":"measurements","columns":["name"],"values":[["mem"],["cpu"]]}]}]}`)
+	b := decodeTestResponse(t, `{"results":[{"statement_id":0,"series":[
+		{"name":"measurements","columns":["name"],"values":[["disk"],["cpu"]]}]}]}`)
+
+	merged := MergeResponses([]*Response{a, b})
+	p, _ := json.Marshal(merged)
+	want := `{"results":[{"statement_id":0,"series":[` +
+		`{"name":"measurements","columns":["name"],"values":[["cpu"],["disk"],["mem"]]}]}]}`
+	if string(p) != want {
+		t.Errorf("merged:\n%s\nwant:\n%s", p, want)
+	}
+}
+
+func TestMergeReplicaRows(t *testing.T) {
+	// two points alike of different series in a, and a replica of them.
+	a := decodeTestResponse(t, `{"results":[{"statement_id":0,"series":[
+		{"name":"cpu","columns":["time","value","host"],"values":[[1,1,"a"],[1,1,"a"]]}]}]}`)
+	b := decodeTestResponse(t, `{"results":[{"statement_id":0,"series":[
+		{"name":"cpu","columns":["time","value","host"],"values":[[1,1,"a"],[1,1,"a"],[1,1,"b"]]}]}]}`)
+
+	merged := MergeResponses([]*Response{a, b})
+	merged.DropColumns([]string{"host"})
+	p, _ := json.Marshal(merged)
+	want := `{"results":[{"statement_id":0,"series":[` +
+		`{"name":"cpu","columns":["time","value"],"values":[[1,1],[1,1],[1,1]]}]}]}`
+	if string(p) != want {
+		t.Errorf("merged:\n%s\nwant:\n%s", p, want)
+	}
+}
+
+func TestWriteChunkedResponse(t *testing.T) {
+	s := `{"results":[{"statement_id":0,"series":[` +
+		`{"name":"cpu","columns":["time","value"],"values":[[1,1],[2,2],[3,3],[4,4],[5,5]]},` +
+		`{"name":"mem","columns":["time","value"],"values":[[1,1],[2,2]]}]}]}`
+	w := httptest.NewRecorder()
+	err := WriteChunkedResponse(w, decodeTestResponse(t, s), 3)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+
+	chunks := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	want := []string{
+		`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[1,1],[2,2],[3,3]],"partial":true}],"partial":true}]}`,
+		`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[4,4],[5,5]]},{"name":"mem","columns":["time","value"],"values":[[1,1]],"partial":true}],"partial":true}]}`,
+		`{"results":[{"statement_id":0,"series":[{"name":"mem","columns":["time","value"],"values":[[2,2]]}]}]}`,
+	}
+	if len(chunks) != len(want) {
+		t.Fatalf("got %d chunks, want %d:\n%s", len(chunks), len(want), w.Body.String())
+	}
+	for i := range want {
+		if chunks[i] != want[i] {
+			t.Errorf("chunk %d:\n%s\nwant:\n%s", i, chunks[i], want[i])
+		}
+	}
+
+	// and back again.
+	p, _ := json.Marshal(decodeTestResponse(t, w.Body.String()))
+	if string(p) != s {
+		t.Errorf("decoded:\n%s\nwant:\n%s", p, s)
+	}
+}
+
+func TestChunkSize(t *testing.T) {
+	for query, want := range map[string]int{
+		"q=select":                            0,
+		"q=select&chunked=true":               DefaultChunkSize,
+		"q=select&chunked=true&chunk_size=5":  5,
+		"q=select&chunked=false&chunk_size=5": 0,
+	} {
+		req, _ := http.NewRequest("GET", "/query?"+query, nil)
+		if got := ChunkSize(req); got != want {
+			t.Errorf("%s: got %d, want %d", query, got, want)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrMissingMeasurement = errors.New("missing measurement")
+	ErrMissingTagKey      = errors.New("missing tag key")
+	ErrMissingTagValue    = errors.New("missing tag value")
+	ErrDuplicateTags      = errors.New("duplicate tags")
+	ErrMissingFields      = errors.New("missing fields")
+	ErrMissingFieldKey    = errors.New("missing field key")
+	ErrMissingFieldValue  = errors.New("missing field value")
+	ErrInvalidNumber      = errors.New("invalid number")
+	ErrInvalidFieldValue  = errors.New("invalid field value")
+	ErrUnbalancedQuotes   = errors.New("unbalanced quotes")
+	ErrInvalidTimestamp   = errors.New("invalid timestamp")
+)
+
+const (
+	measurementEscapes = ", "
+	tagEscapes         = ",= "
+)
+
+// ParseError tells why a line of line protocol is invalid.
+type ParseError struct {
+	Line []byte
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("unable to parse '%s': %s", e.Line, e.Err)
+}
+
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// Field values are float64, int64, uint64, string or bool.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Point is a parsed line of line protocol, names and strings unescaped.
+type Point struct {
+	Measurement string
+	Tags        []Tag
+	Fields      []Field
+	Time        int64
+	HasTime     bool
+	Line        []byte // as received, without surrounding blanks
+}
+
+// TagMap returns the tags by key.
+func (pt *Point) TagMap() (tags map[string]string) {
+	tags = make(map[string]string, len(pt.Tags))
+	for _, tag := range pt.Tags {
+		tags[tag.Key] = tag.Value
+	}
+	return
+}
+
+// ParsePoint parses and checks a line of line protocol. A blank line or a
+// comment gives a nil point and no error.
+func ParsePoint(line []byte) (pt *Point, err error) {
+	line = bytes.Trim(line, " \t\r\n")
+	if len(line) == 0 || line[0] == '#' {
+		return
+	}
+
+	pt = &Point{Line: line}
+	defer func() {
+		if err != nil {
+			pt, err = nil, &ParseError{Line: line, Err: err}
+		}
+	}()
+
+	var i int
+	pt.Measurement, i, err = scanMeasurement(line)
+	if err != nil {
+		return
+	}
+
+	seen := make(map[string]bool)
+	for i < len(line) && line[i] == ',' {
+		var tag Tag
+		tag.Key, i = scanName(line, i+1, "=, ", tagEscapes)
+		if tag.Key == "" {
+			return pt, ErrMissingTagKey
+		}
+		if i >= len(line) || line[i] != '=' {
+			return pt, ErrMissingTagValue
+		}
+		tag.Value, i = scanName(line, i+1, ", ", tagEscapes)
+		if tag.Value == "" {
+			return pt, ErrMissingTagValue
+		}
+		if seen[tag.Key] {
+			return pt, ErrDuplicateTags
+		}
+		seen[tag.Key] = true
+		pt.Tags = append(pt.Tags, tag)
+	}
+
+	i = skipBlanks(line, i)
+	if i >= len(line) {
+		return pt, ErrMissingFields
+	}
+	for {
+		var field Field
+		field.Key, i = scanName(line, i, "=, ", tagEscapes)
+		if field.Key == "" {
+			return pt, ErrMissingFieldKey
+		}
+		if i >= len(line) || line[i] != '=' {
+			return pt, ErrMissingFieldValue
+		}
+		field.Value, i, err = scanFieldValue(line, i+1)
+		if err != nil {
+			return
+		}
+		pt.Fields = append(pt.Fields, field)
+		if i >= len(line) || line[i] != ',' {
+			break
+		}
+		i++
+	}
+
+	i = skipBlanks(line, i)
+	if i < len(line) {
+		pt.Time, err = strconv.ParseInt(string(line[i:]), 10, 64)
+		if err != nil {
+			return pt, ErrInvalidTimestamp
+		}
+		pt.HasTime = true
+	}
+	return
+}
+
+// ScanKey returns the measurement of a line.
+func ScanKey(pointBuf []byte) (key string, err error) {
+	key, _, err = scanMeasurement(pointBuf)
+	return
+}
+
+// scanMeasurement returns the unescaped measurement and the index of the
+// comma or blank which ends it.
+func scanMeasurement(buf []byte) (name string, i int, err error) {
+	name, i = scanName(buf, 0, ", ", measurementEscapes)
+	if name == "" {
+		return "", i, ErrMissingMeasurement
+	}
+	if i >= len(buf) {
+		return name, i, ErrMissingFields
+	}
+	return
+}
+
+// scanName reads from start up to the first unescaped byte of stops, and
+// removes the backslashes before bytes of escapes. Other backslashes stay.
+func scanName(buf []byte, start int, stops string, escapes string) (name string, i int) {
+	var b []byte
+	for i = start; i < len(buf); i++ {
+		c := buf[i]
+		if c == '\\' && i+1 < len(buf) && strings.IndexByte(escapes, buf[i+1]) >= 0 {
+			i++
+			b = append(b, buf[i])
+			continue
+		}
+		if strings.IndexByte(stops, c) >= 0 {
+			break
+		}
+		b = append(b, c)
+	}
+	return string(b), i
+}
+
+func skipBlanks(buf []byte, i int) int {
+	for i < len(buf) && buf[i] == ' ' {
+		i++
+	}
+	return i
+}
+
+func scanFieldValue(buf []byte, start int) (value interface{}, i int, err error) {
+	if start >= len(buf) || buf[start] == ',' || buf[start] == ' ' {
+		return nil, start, ErrMissingFieldValue
+	}
+
+	if buf[start] == '"' {
+		var b []byte
+		for i = start + 1; i < len(buf); i++ {
+			c := buf[i]
+			if c == '\\' && i+1 < len(buf) && (buf[i+1] == '"' || buf[i+1] == '\\') {
+				i++
+				b = append(b, buf[i])
+				continue
+			}
+			if c == '"' {
+				return string(b), i + 1, nil
+			}
+			b = append(b, c)
+		}
+		return nil, i, ErrUnbalancedQuotes
+	}
+
+	for i = start; i < len(buf) && buf[i] != ',' && buf[i] != ' '; i++ {
+	}
+	s := string(buf[start:i])
+	switch s {
+	case "t", "T", "true", "True", "TRUE":
+		return true, i, nil
+	case "f", "F", "false", "False", "FALSE":
+		return false, i, nil
+	}
+
+	c := s[0]
+	if c != '-' && c != '+' && c != '.' && (c < '0' || c > '9') {
+		return nil, i, ErrInvalidFieldValue
+	}
+	switch s[len(s)-1] {
+	case 'i':
+		value, err = strconv.ParseInt(s[:len(s)-1], 10, 64)
+	case 'u':
+		value, err = strconv.ParseUint(s[:len(s)-1], 10, 64)
+	default:
+		var f float64
+		f, err = strconv.ParseFloat(s, 64)
+		if err == nil && (math.IsInf(f, 0) || math.IsNaN(f) || strings.ContainsAny(s, "xX")) {
+			err = ErrInvalidNumber
+		}
+		value = f
+	}
+	if err != nil {
+		return nil, i, ErrInvalidNumber
+	}
+	return
+}
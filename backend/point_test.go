@@ -0,0 +1,88 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePoint(t *testing.T) {
+	pt, err := ParsePoint([]byte("temper\\,ature,machine=unit\\ 42,type=assem\\=bly internal=32i,ratio=0.5,on=t,name=\"a \\\"b\\\", c\",count=3u 1434055562000000035\n"))
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	want := &Point{
+		Measurement: "temper,ature",
+		Tags:        []Tag{{"machine", "unit 42"}, {"type", "assem=bly"}},
+		Fields: []Field{
+			{"internal", int64(32)},
+			{"ratio", 0.5},
+			{"on", true},
+			{"name", "a \"b\", c"},
+			{"count", uint64(3)},
+		},
+		Time:    1434055562000000035,
+		HasTime: true,
+		Line:    pt.Line,
+	}
+	if !reflect.DeepEqual(pt, want) {
+		t.Errorf("parsed %+v\nwant %+v", pt, want)
+	}
+
+	for _, line := range []string{"", "  \n", "# comment"} {
+		pt, err = ParsePoint([]byte(line))
+		if pt != nil || err != nil {
+			t.Errorf("%q: got %v %v", line, pt, err)
+		}
+	}
+}
+
+func TestParsePointErrors(t *testing.T) {
+	tests := []struct {
+		line string
+		want error
+	}{
+		{"cpu", ErrMissingFields},
+		{"cpu\\", ErrMissingFields},
+		{",host=a value=1", ErrMissingMeasurement},
+		{"cpu,host value=1", ErrMissingTagValue},
+		{"cpu,host= value=1", ErrMissingTagValue},
+		{"cpu,=a value=1", ErrMissingTagKey},
+		{"cpu,host=a,host=b value=1", ErrDuplicateTags},
+		{"cpu,host=a", ErrMissingFields},
+		{"cpu,host=a ", ErrMissingFields},
+		{"cpu value", ErrMissingFieldValue},
+		{"cpu value=", ErrMissingFieldValue},
+		{"cpu =1", ErrMissingFieldKey},
+		{"cpu value=abc", ErrInvalidFieldValue},
+		{"cpu value=tru", ErrInvalidFieldValue},
+		{"cpu value=1.2.3", ErrInvalidNumber},
+		{"cpu value=12ai", ErrInvalidNumber},
+		{"cpu value=-1u", ErrInvalidNumber},
+		{"cpu value=-Inf", ErrInvalidNumber},
+		{"cpu value=0x10", ErrInvalidNumber},
+		{"cpu value=\"abc", ErrUnbalancedQuotes},
+		{"cpu value=1 14340a", ErrInvalidTimestamp},
+		{"cpu value=1 1 2", ErrInvalidTimestamp},
+	}
+	for _, tt := range tests {
+		_, err := ParsePoint([]byte(tt.line))
+		perr, ok := err.(*ParseError)
+		if !ok || perr.Err != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.line, err, tt.want)
+		}
+	}
+}
+
+func BenchmarkParsePoint(b *testing.B) {
+	line := []byte("cpu,host=server01,region=uswest idle=1,user=2i,name=\"a\" 1434055562000000000")
+	for i := 0; i < b.N; i++ {
+		_, err := ParsePoint(line)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/influxdata/influxql"
+)
+
+var (
+	ErrStatementForbidden   = errors.New("statement forbidden")
+	ErrMeasurementForbidden = errors.New("measurement forbidden")
+	ErrIntoForbidden        = errors.New("into forbidden")
+	ErrTimeRangeRequired    = errors.New("time range required")
+	ErrTimeSpanTooLarge     = errors.New("time span too large")
+	ErrGroupByTooFine       = errors.New("group by time too fine")
+	ErrLimitRequired        = errors.New("limit required")
+	ErrSLimitRequired       = errors.New("slimit required")
+)
+
+// DefaultAllowStatements are the statements allowed without a policy.
+var DefaultAllowStatements = []string{
+	"select",
+	"delete",
+	"delete_series",
+	"show_measurements",
+	"show_tag_keys",
+	"show_tag_values",
+	"show_field_keys",
+	"show_series",
+	"show_databases",
+	"show_retention_policies",
+}
+
+// Policy decides on parsed statements whether a query may pass.
+type Policy struct {
+	allowStatements   map[string]bool
+	denyStatements    map[string]bool
+	allowMeasurements []*regexp.Regexp
+	denyMeasurements  []*regexp.Regexp
+	allowInto         []*regexp.Regexp
+	requireTimeRange  bool
+	maxTimeSpan       time.Duration
+	minGroupBy        time.Duration
+	requireLimit      bool
+	requireSLimit     bool
+}
+
+func compileGlobs(globs []string) (rs []*regexp.Regexp, err error) {
+	for _, glob := range globs {
+		r, err := regexp.Compile(GlobToRegexp(glob))
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+	return
+}
+
+func matchAny(rs []*regexp.Regexp, s string) bool {
+	for _, r := range rs {
+		if r.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func NewPolicy(cfg *PolicyConfig) (p *Policy, err error) {
+	p = &Policy{
+		allowStatements:  make(map[string]bool),
+		denyStatements:   make(map[string]bool),
+		requireTimeRange: cfg.RequireTimeRange,
+		requireLimit:     cfg.RequireLimit,
+		requireSLimit:    cfg.RequireSLimit,
+	}
+
+	allow := cfg.AllowStatements
+	if len(allow) == 0 {
+		allow = DefaultAllowStatements
+	}
+	for _, s := range allow {
+		p.allowStatements[s] = true
+	}
+	for _, s := range cfg.DenyStatements {
+		p.denyStatements[s] = true
+	}
+
+	p.allowMeasurements, err = compileGlobs(cfg.AllowMeasurements)
+	if err != nil {
+		return
+	}
+	p.denyMeasurements, err = compileGlobs(cfg.DenyMeasurements)
+	if err != nil {
+		return
+	}
+	p.allowInto, err = compileGlobs(cfg.AllowInto)
+	if err != nil {
+		return
+	}
+
+	if cfg.MaxTimeSpan != "" {
+		p.maxTimeSpan, err = influxql.ParseDuration(cfg.MaxTimeSpan)
+		if err != nil {
+			return
+		}
+	}
+	if cfg.MinGroupByInterval != "" {
+		p.minGroupBy, err = influxql.ParseDuration(cfg.MinGroupByInterval)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// StatementType names a statement in snake case, like show_tag_keys.
+func StatementType(stmt influxql.Statement) string {
+	name := fmt.Sprintf("%T", stmt)
+	name = strings.TrimPrefix(name, "*influxql.")
+	name = strings.TrimSuffix(name, "Statement")
+	var b strings.Builder
+	for i, c := range name {
+		if unicode.IsUpper(c) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			c = unicode.ToLower(c)
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// measurementsOfStatement walks sources and subqueries, leaving INTO out.
+func measurementsOfStatement(stmt influxql.Statement) (measurements []*influxql.Measurement) {
+	var walk func(sources influxql.Sources)
+	walk = func(sources influxql.Sources) {
+		for _, source := range sources {
+			switch s := source.(type) {
+			case *influxql.Measurement:
+				measurements = append(measurements, s)
+			case *influxql.SubQuery:
+				walk(s.Statement.Sources)
+			}
+		}
+	}
+	if sources, ok := GetSourcesFromStatement(stmt); ok {
+		walk(sources)
+	}
+	if s, ok := stmt.(*influxql.DeleteStatement); ok {
+		walk(influxql.Sources{s.Source})
+	}
+	return
+}
+
+func (p *Policy) checkMeasurement(m *influxql.Measurement) (err error) {
+	// a regex may name anything, only a catch-all allow lets it pass.
+	if m.Regex != nil {
+		if len(p.denyMeasurements) > 0 || (len(p.allowMeasurements) > 0 && !matchAny(p.allowMeasurements, "*")) {
+			return ErrMeasurementForbidden
+		}
+		return
+	}
+	if matchAny(p.denyMeasurements, m.Name) {
+		return ErrMeasurementForbidden
+	}
+	if len(p.allowMeasurements) > 0 && !matchAny(p.allowMeasurements, m.Name) {
+		return ErrMeasurementForbidden
+	}
+	return
+}
+
+func (p *Policy) checkSelect(stmt *influxql.SelectStatement) (err error) {
+	if stmt.Target != nil {
+		if stmt.Target.Measurement == nil || !matchAny(p.allowInto, stmt.Target.Measurement.Name) {
+			return ErrIntoForbidden
+		}
+	}
+
+	if p.requireTimeRange || p.maxTimeSpan > 0 {
+		now := time.Now()
+		_, tr, err := influxql.ConditionExpr(stmt.Condition, &influxql.NowValuer{Now: now})
+		if err != nil {
+			return err
+		}
+		if tr.Min.IsZero() {
+			return ErrTimeRangeRequired
+		}
+		max := tr.Max
+		if max.IsZero() || max.After(now) {
+			max = now
+		}
+		if p.maxTimeSpan > 0 && max.Sub(tr.Min) > p.maxTimeSpan {
+			return ErrTimeSpanTooLarge
+		}
+	}
+
+	if p.minGroupBy > 0 {
+		interval, err := stmt.GroupByInterval()
+		if err != nil {
+			return err
+		}
+		if interval > 0 && interval < p.minGroupBy {
+			return ErrGroupByTooFine
+		}
+	}
+
+	if p.requireLimit && stmt.Limit == 0 {
+		return ErrLimitRequired
+	}
+	if p.requireSLimit && stmt.SLimit == 0 {
+		return ErrSLimitRequired
+	}
+	return
+}
+
+// Check tells whether a statement is allowed by the policy.
+func (p *Policy) Check(stmt influxql.Statement) (err error) {
+	t := StatementType(stmt)
+	if p.denyStatements[t] || !p.allowStatements[t] {
+		return ErrStatementForbidden
+	}
+
+	for _, m := range measurementsOfStatement(stmt) {
+		err = p.checkMeasurement(m)
+		if err != nil {
+			return
+		}
+	}
+
+	if s, ok := stmt.(*influxql.SelectStatement); ok {
+		return p.checkSelect(s)
+	}
+	return
+}
@@ -0,0 +1,164 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+
+	"github.com/influxdata/influxql"
+)
+
+var (
+	SupportedCommandList = []string{
+		"SELECT * FROM cpu",
+		"SELECT * FROM \"cpu\"",
+		"SELECT xx FROM cpu WHERE region='uswest' AND price=10",
+		"SELECT mean(\"value\") FROM \"cpu\" WHERE \"region\" = 'uswest' GROUP BY time(10m) fill(0)",
+		"SHOW FIELD KEYS FROM cpu",
+		"SHOW FIELD KEYS FROM \"cpu\"",
+		"SHOW SERIES FROM \"telegraf\".\"autogen\".\"cpu\" WHERE cpu = 'cpu8'",
+		"SHOW TAG KEYS FROM cpu",
+		"SHOW TAG KEYS FROM \"cpu\" WHERE \"region\" = 'uswest'",
+		"SHOW TAG KEYS FROM cpu WHERE \"host\" = 'serverA'",
+		"SHOW TAG VALUES FROM cpu WITH KEY = \"region\"",
+		"SHOW TAG VALUES FROM \"1h\".\"cpu\" WITH KEY = \"region\"",
+		"SHOW TAG VALUES FROM cpu WITH KEY !~ /.*c.*/",
+		"SHOW TAG VALUES FROM \"cpu\" WITH KEY IN (\"region\", \"host\") WHERE \"service\" = 'redis'",
+		"SHOW FIELD KEYS FROM \"1h\".\"cpu\"",
+		"SHOW FIELD KEYS FROM \"cpu.load\"",
+		"SHOW FIELD KEYS FROM \"1h\".\"cpu.load\"",
+		"DELETE FROM \"cpu\"",
+		"DELETE FROM \"cpu\" WHERE time < '2000-01-01T00:00:00Z'",
+		"SHOW MEASUREMENTS",
+		"SHOW TAG KEYS",
+		"SHOW FIELD KEYS",
+		"SHOW SERIES",
+		"SHOW DATABASES",
+		"SHOW RETENTION POLICIES ON \"mydb\"",
+		"/* comment */ SELECT * FROM cpu",
+		"SELECT\n\t*\nFROM\tcpu",
+	}
+	UnsupportedCommandList = []string{
+		"REVOKE ALL PRIVILEGES FROM \"jdoe\"",
+		"REVOKE READ ON \"mydb\" FROM \"jdoe\"",
+		"DROP SERIES FROM \"telegraf\".\"autogen\".\"cpu\" WHERE cpu = 'cpu8'",
+		"SELECT * INTO memory FROM cpu",
+		"SELECT * INTO memory FROM cpu;SELECT * INTO memory FROM cpu",
+		";SELECT * INTO memory FROM cpu",
+		";SELECT * INTO memory FROM cpu;",
+		"-- comment\nDROP MEASUREMENT cpu",
+		"  drop   database   mydb",
+		"CREATE USER \"jdoe\" WITH PASSWORD '1337password'",
+		"GRANT ALL TO \"jdoe\"",
+	}
+)
+
+// checkTestQuery passes when every statement of the batch is allowed.
+func checkTestQuery(p *Policy, q string) (err error) {
+	query, err := influxql.ParseQuery(q)
+	if err != nil {
+		return
+	}
+	for _, stmt := range query.Statements {
+		err = p.Check(stmt)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func TestSupportedCmds(t *testing.T) {
+	p, err := NewPolicy(&PolicyConfig{})
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	for _, cmd := range SupportedCommandList {
+		if err := checkTestQuery(p, cmd); err != nil {
+			t.Errorf("Error testing supported cmd: %s, %s", cmd, err)
+		}
+	}
+}
+
+func TestUnsupportedCmds(t *testing.T) {
+	p, err := NewPolicy(&PolicyConfig{})
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	for _, cmd := range UnsupportedCommandList {
+		if checkTestQuery(p, cmd) == nil {
+			t.Errorf("Error testing unsupported cmd: %s", cmd)
+		}
+	}
+}
+
+func TestStatementType(t *testing.T) {
+	tests := map[string]string{
+		"SELECT * FROM cpu":           "select",
+		"SHOW TAG KEYS FROM cpu":      "show_tag_keys",
+		"DROP SERIES FROM cpu":        "drop_series",
+		"SHOW RETENTION POLICIES":     "show_retention_policies",
+		"DELETE FROM cpu WHERE a='b'": "delete_series",
+	}
+	for q, want := range tests {
+		stmt, err := influxql.ParseStatement(q)
+		if err != nil {
+			t.Errorf("error: %s", err)
+			continue
+		}
+		if got := StatementType(stmt); got != want {
+			t.Errorf("type of %s: %s, want %s", q, got, want)
+		}
+	}
+}
+
+func TestPolicyRules(t *testing.T) {
+	cfg := &PolicyConfig{
+		DenyStatements:     []string{"delete_series"},
+		AllowMeasurements:  []string{"cpu", "app.*"},
+		DenyMeasurements:   []string{"app.secret"},
+		AllowInto:          []string{"cpu_1h"},
+		RequireTimeRange:   true,
+		MaxTimeSpan:        "7d",
+		MinGroupByInterval: "1m",
+		RequireLimit:       true,
+	}
+	p, err := NewPolicy(cfg)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+
+	tests := []struct {
+		query string
+		want  error
+	}{
+		{"SELECT * FROM cpu WHERE time > now() - 1h LIMIT 10", nil},
+		{"SELECT * FROM \"app.web\" WHERE time > now() - 1h LIMIT 10", nil},
+		{"SELECT * FROM mem WHERE time > now() - 1h LIMIT 10", ErrMeasurementForbidden},
+		{"SELECT * FROM \"app.secret\" WHERE time > now() - 1h LIMIT 10", ErrMeasurementForbidden},
+		{"SELECT * FROM /cpu/ WHERE time > now() - 1h LIMIT 10", ErrMeasurementForbidden},
+		{"SELECT * FROM (SELECT * FROM mem) WHERE time > now() - 1h LIMIT 10", ErrMeasurementForbidden},
+		{"SELECT * FROM cpu LIMIT 10", ErrTimeRangeRequired},
+		{"SELECT * FROM cpu WHERE time > now() - 30d LIMIT 10", ErrTimeSpanTooLarge},
+		{"SELECT * FROM cpu WHERE time > now() - 30d AND time < now() - 29d LIMIT 10", nil},
+		{"SELECT mean(v) FROM cpu WHERE time > now() - 1h GROUP BY time(10s) LIMIT 10", ErrGroupByTooFine},
+		{"SELECT mean(v) FROM cpu WHERE time > now() - 1h GROUP BY time(5m) LIMIT 10", nil},
+		{"SELECT * FROM cpu WHERE time > now() - 1h", ErrLimitRequired},
+		{"SELECT mean(v) INTO cpu_1h FROM cpu WHERE time > now() - 1h GROUP BY time(1h) LIMIT 10", nil},
+		{"SELECT mean(v) INTO mem_1h FROM cpu WHERE time > now() - 1h GROUP BY time(1h) LIMIT 10", ErrIntoForbidden},
+		{"DELETE FROM cpu WHERE time < now() - 30d", ErrStatementForbidden},
+		{"SHOW TAG KEYS FROM cpu", nil},
+	}
+	for _, tt := range tests {
+		stmt, err := influxql.ParseStatement(tt.query)
+		if err != nil {
+			t.Errorf("error: %s", err)
+			continue
+		}
+		if err = p.Check(stmt); err != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.query, err, tt.want)
+		}
+	}
+}
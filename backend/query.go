@@ -0,0 +1,477 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/influxdata/influxql"
+)
+
+var (
+	ErrQueryFailed = errors.New("query error")
+)
+
+// responseBuffer keeps a backend response in memory, so several can be merged.
+type responseBuffer struct {
+	header http.Header
+	status int
+	buffer bytes.Buffer
+}
+
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{
+		header: make(http.Header),
+	}
+}
+
+func (rb *responseBuffer) Header() http.Header {
+	return rb.header
+}
+
+func (rb *responseBuffer) Write(p []byte) (n int, err error) {
+	if rb.status == 0 {
+		rb.status = 200
+	}
+	return rb.buffer.Write(p)
+}
+
+func (rb *responseBuffer) WriteHeader(code int) {
+	rb.status = code
+}
+
+// WriteTo passes the buffered response through to w.
+func (rb *responseBuffer) WriteTo(w http.ResponseWriter) (err error) {
+	copyHeader(w.Header(), rb.header)
+	w.WriteHeader(rb.status)
+	_, err = w.Write(rb.buffer.Bytes())
+	return
+}
+
+// queryReplicas tries the replicas one by one, same zone first, then other
+// zones, passing non-active ones, until one answers. With hedging on, a
+// replica slow to answer doesn't hold the others back.
+func (ic *InfluxCluster) queryReplicas(w http.ResponseWriter, req *http.Request, apis []BackendApi) (err error) {
+	apis = ic.replicaOrder(apis)
+	if ic.QueryHedgeDelay > 0 || ic.QueryRace != 0 {
+		delay := time.Duration(ic.QueryHedgeDelay) * time.Millisecond
+		return ic.queryHedged(w, req, apis, delay, ic.QueryRace != 0)
+	}
+
+	err = ErrQueryFailed
+	for _, api := range apis {
+		err = api.Query(w, req)
+		if err == nil || err == ErrResponseInterrupted || err == ErrQueryTimeout {
+			return
+		}
+		// the client is gone.
+		if req.Context().Err() != nil {
+			return
+		}
+	}
+	return
+}
+
+// writeQueryError answers a query no replica answered.
+func writeQueryError(w http.ResponseWriter, err error) {
+	if err == ErrQueryTimeout {
+		_ = WriteResponse(w, 504, &Response{Err: err.Error()})
+		return
+	}
+	w.WriteHeader(400)
+	_, _ = w.Write([]byte("query error"))
+}
+
+// replicaOrder lists the replicas a query may go to in the order to try
+// them, same zone first.
+func (ic *InfluxCluster) replicaOrder(apis []BackendApi) (ordered []BackendApi) {
+	for _, api := range apis {
+		if api.GetZone() != ic.zone {
+			continue
+		}
+		if !api.IsActive() || api.IsWriteOnly() {
+			continue
+		}
+		ordered = append(ordered, api)
+	}
+
+	for _, api := range apis {
+		if api.GetZone() == ic.zone {
+			continue
+		}
+		if !api.IsActive() {
+			continue
+		}
+		ordered = append(ordered, api)
+	}
+	return
+}
+
+func groupKey(apis []BackendApi) string {
+	keys := make([]string, 0, len(apis))
+	for _, api := range apis {
+		keys = append(keys, fmt.Sprintf("%p", api))
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+// querySources splits a statement reading several sources into one statement
+// per backend group, runs them together and merges the answers. A regex
+// source is asked of every group.
+func (ic *InfluxCluster) querySources(w http.ResponseWriter, req *http.Request, stmt influxql.Statement, sources influxql.Sources, rt *routeTable) (err error) {
+	var keys []string
+	groups := make(map[string][]BackendApi)
+	groupSources := make(map[string]influxql.Sources)
+	add := func(group []BackendApi, source influxql.Source) {
+		key := groupKey(group)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+			groups[key] = group
+		}
+		groupSources[key] = append(groupSources[key], source)
+	}
+
+	// every backend of a sharded measurement is a group of its own, the
+	// answers of which must merge into that of the measurement.
+	var shardTags []string
+	sharded := func(shard *shardRoute) bool {
+		if !MergeableAcrossShards(stmt, shard.rule.Tags) {
+			log.Printf("unmergeable query over shards: %s\n", stmt)
+			w.WriteHeader(400)
+			_, _ = w.Write([]byte(ErrUnmergeableShards.Error()))
+			return false
+		}
+		for _, k := range shard.rule.Tags {
+			if indexOf(shardTags, k) < 0 {
+				shardTags = append(shardTags, k)
+			}
+		}
+		return true
+	}
+
+	for _, source := range sources {
+		switch s := source.(type) {
+		case *influxql.Measurement:
+			if s.Regex != nil {
+				for name, shard := range rt.measurementToShards {
+					if s.Regex.Val.MatchString(name) && !sharded(shard) {
+						return ErrUnmergeableShards
+					}
+				}
+				for _, group := range rt.allGroups() {
+					add(group, s)
+				}
+				continue
+			}
+			if shard, ok := rt.GetShard(s.Name); ok && !sharded(shard) {
+				return ErrUnmergeableShards
+			}
+			sourceGroups, ok := rt.resolveGroups(s.Name)
+			if !ok {
+				log.Printf("unknown measurement: %s,the query is %s\n", s.Name, stmt)
+				w.WriteHeader(400)
+				_, _ = w.Write([]byte("unknown measurement"))
+				return ErrQueryFailed
+			}
+			for _, group := range sourceGroups {
+				add(group, s)
+			}
+		case *influxql.SubQuery:
+			// a subquery can't be split, all it reads must live together.
+			var sourceGroups [][]BackendApi
+			distinct := make(map[string]bool)
+			influxql.WalkFunc(s.Statement, func(n influxql.Node) {
+				m, ok := n.(*influxql.Measurement)
+				if !ok || m.Name == "" {
+					return
+				}
+				mGroups, _ := rt.resolveGroups(m.Name)
+				for _, group := range mGroups {
+					if !distinct[groupKey(group)] {
+						distinct[groupKey(group)] = true
+						sourceGroups = append(sourceGroups, group)
+					}
+				}
+			})
+			if len(sourceGroups) != 1 {
+				log.Printf("subquery spans backend groups: %s\n", stmt)
+				w.WriteHeader(400)
+				_, _ = w.Write([]byte("subquery spans multiple backend groups"))
+				return ErrQueryFailed
+			}
+			add(sourceGroups[0], s)
+		}
+	}
+
+	if len(keys) == 0 {
+		w.WriteHeader(400)
+		_, _ = w.Write([]byte("unknown measurement"))
+		return ErrQueryFailed
+	}
+	if len(keys) == 1 {
+		err = ic.queryReplicas(w, req, groups[keys[0]])
+		if err != nil && err != ErrResponseInterrupted {
+			writeQueryError(w, err)
+		}
+		return
+	}
+
+	fanOutGroups := make([][]BackendApi, len(keys))
+	queries := make([]string, len(keys))
+	var added []string
+	for i, key := range keys {
+		sub, err := influxql.ParseStatement(stmt.String())
+		if err != nil {
+			w.WriteHeader(400)
+			_, _ = w.Write([]byte("can't get measurement or influxql is invalid"))
+			return err
+		}
+		SetSourcesOfStatement(sub, groupSources[key])
+		added = selectShardTags(sub, shardTags)
+		fanOutGroups[i] = groups[key]
+		queries[i] = sub.String()
+	}
+
+	bufs, errs := ic.queryFanOut(req, fanOutGroups, queries)
+	resp, err := mergeFanOut(w, bufs, errs, 0)
+	if err != nil {
+		return
+	}
+	resp.DropColumns(added)
+	orderMerged(stmt, resp)
+	return writeMerged(w, req, resp)
+}
+
+// orderMerged puts the rows of a merged answer in the order stmt asked
+// for, as merging sorts them by time.
+func orderMerged(stmt influxql.Statement, resp *Response) {
+	if sel, ok := stmt.(*influxql.SelectStatement); ok && len(sel.SortFields) > 0 && !sel.SortFields[0].Ascending {
+		resp.Reverse()
+	}
+}
+
+// writeMerged writes a response the proxy put together, in chunks if req
+// asked for them.
+func writeMerged(w http.ResponseWriter, req *http.Request, resp *Response) (err error) {
+	if size := ChunkSize(req); size > 0 {
+		return WriteChunkedResponse(w, resp, size)
+	}
+	return WriteResponse(w, 200, resp)
+}
+
+// queryDatabase answers SHOW statements about the whole database. SHOW
+// DATABASES is answered by the proxy itself, the others are sent to one
+// replica of every backend group and the union is returned.
+func (ic *InfluxCluster) queryDatabase(w http.ResponseWriter, req *http.Request, stmt influxql.Statement, rt *routeTable) (err error) {
+	if _, ok := stmt.(*influxql.ShowDatabasesStatement); ok {
+		row := &models.Row{Name: "databases", Columns: []string{"name"}}
+		for _, db := range ic.databases() {
+			row.Values = append(row.Values, []interface{}{db})
+		}
+		return writeMerged(w, req, &Response{Results: []*Result{{Series: []*models.Row{row}}}})
+	}
+
+	// ON selects the routing table, and is sent as the db parameter since
+	// backends may name the database differently.
+	db := GetDatabaseOfStatement(stmt)
+	if db != "" {
+		var ok bool
+		rt, ok = ic.getRoutes(db)
+		if !ok {
+			return WriteResponse(w, 200, &Response{Results: []*Result{{Err: "database not found: " + db}}})
+		}
+		req = cloneQueryRequest(req)
+		req.Form.Set("db", db)
+	}
+	SetDatabaseOfStatement(stmt, "")
+
+	// every backend has the retention policies of the database, a union
+	// would repeat or mix them.
+	if _, ok := stmt.(*influxql.ShowRetentionPoliciesStatement); ok {
+		group, ok := rt.defaultGroup()
+		if !ok {
+			return WriteResponse(w, 200, &Response{Results: []*Result{{}}})
+		}
+		req = cloneQueryRequest(req)
+		req.Form.Set("q", stmt.String())
+		err = ic.queryReplicas(w, req, group)
+		if err != nil && err != ErrResponseInterrupted {
+			writeQueryError(w, err)
+		}
+		return
+	}
+
+	limits := widenShowLimits(stmt)
+	groups := rt.allGroups()
+	queries := make([]string, len(groups))
+	for i := range groups {
+		queries[i] = stmt.String()
+	}
+	bufs, errs := ic.queryFanOut(req, groups, queries)
+	resp, err := mergeFanOut(w, bufs, errs, 0)
+	if err != nil {
+		return
+	}
+	limits.apply(resp)
+	return writeMerged(w, req, resp)
+}
+
+// showLimits are the limits and offsets of a SHOW statement, which hold
+// for the union rather than the answer of each backend.
+type showLimits struct {
+	limit, offset   int
+	slimit, soffset int
+}
+
+// widenShowLimits takes the offsets out of stmt and raises its limits by
+// them, so that each backend answers with every row the union may keep.
+func widenShowLimits(stmt influxql.Statement) (l showLimits) {
+	var limit, offset, slimit, soffset *int
+	switch s := stmt.(type) {
+	case *influxql.ShowMeasurementsStatement:
+		limit, offset = &s.Limit, &s.Offset
+	case *influxql.ShowTagKeysStatement:
+		limit, offset, slimit, soffset = &s.Limit, &s.Offset, &s.SLimit, &s.SOffset
+	case *influxql.ShowTagValuesStatement:
+		limit, offset = &s.Limit, &s.Offset
+	case *influxql.ShowFieldKeysStatement:
+		limit, offset = &s.Limit, &s.Offset
+	case *influxql.ShowSeriesStatement:
+		limit, offset = &s.Limit, &s.Offset
+	}
+	if limit != nil {
+		l.limit, l.offset = *limit, *offset
+		if *limit > 0 {
+			*limit += *offset
+		}
+		*offset = 0
+	}
+	if slimit != nil {
+		l.slimit, l.soffset = *slimit, *soffset
+		if *slimit > 0 {
+			*slimit += *soffset
+		}
+		*soffset = 0
+	}
+	return
+}
+
+// apply keeps the series of each result, and the rows of each series,
+// within the limits.
+func (l showLimits) apply(resp *Response) {
+	for _, result := range resp.Results {
+		var series []*models.Row
+		for i, row := range result.Series {
+			if i < l.soffset {
+				continue
+			}
+			if l.slimit > 0 && len(series) == l.slimit {
+				break
+			}
+			values := row.Values
+			if l.offset < len(values) {
+				values = values[l.offset:]
+			} else {
+				values = nil
+			}
+			if l.limit > 0 && len(values) > l.limit {
+				values = values[:l.limit]
+			}
+			if len(values) == 0 {
+				continue
+			}
+			row.Values = values
+			series = append(series, row)
+		}
+		result.Series = series
+	}
+}
+
+// cloneQueryRequest asks for plain JSON, so that responses can be merged.
+func cloneQueryRequest(req *http.Request) (r *http.Request) {
+	r = req.Clone(req.Context())
+	r.Body = nil
+	r.Header.Del("Accept-Encoding")
+	r.Header.Del("Accept")
+	return
+}
+
+// queryFanOut runs req on one replica of every group concurrently. If
+// queries is not nil, group i is asked queries[i] instead of the original.
+func (ic *InfluxCluster) queryFanOut(req *http.Request, groups [][]BackendApi, queries []string) (bufs []*responseBuffer, errs []error) {
+	bufs = make([]*responseBuffer, len(groups))
+	errs = make([]error, len(groups))
+	var wg sync.WaitGroup
+	for i, group := range groups {
+		wg.Add(1)
+		go func(i int, group []BackendApi) {
+			defer wg.Done()
+			bufs[i] = newResponseBuffer()
+			r := cloneQueryRequest(req)
+			if queries != nil {
+				r.Form.Set("q", queries[i])
+			}
+			errs[i] = ic.queryReplicas(bufs[i], r, group)
+			if errs[i] == nil && bufs[i].status/100 != 2 {
+				errs[i] = ErrQueryFailed
+			}
+		}(i, group)
+	}
+	wg.Wait()
+	return
+}
+
+// mergeFanOut merges the answers of a fan out, tolerating up to tolerance
+// failed groups. Otherwise a backend error is passed through to w.
+func mergeFanOut(w http.ResponseWriter, bufs []*responseBuffer, errs []error, tolerance int) (merged *Response, err error) {
+	var resps []*Response
+	var failed *responseBuffer
+	for i, buf := range bufs {
+		if errs[i] != nil {
+			if failed == nil && buf.status != 0 {
+				failed = buf
+			}
+			continue
+		}
+		resp, err := DecodeResponse(&buf.buffer)
+		if err != nil {
+			log.Printf("decode response error: %s\n", err)
+			errs[i] = err
+			continue
+		}
+		resps = append(resps, resp)
+	}
+
+	if len(bufs)-len(resps) > tolerance {
+		if failed != nil {
+			_ = failed.WriteTo(w)
+			return nil, ErrQueryFailed
+		}
+		for _, e := range errs {
+			if e == ErrQueryTimeout {
+				writeQueryError(w, e)
+				return nil, e
+			}
+		}
+		writeQueryError(w, ErrQueryFailed)
+		return nil, ErrQueryFailed
+	}
+	merged = MergeResponses(resps)
+	// backends with nothing to say may answer 204, no body at all
+	if len(merged.Results) == 0 && merged.Err == "" {
+		merged.Results = []*Result{{}}
+	}
+	return
+}
@@ -0,0 +1,147 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrReplayPaused = errors.New("replay paused")
+)
+
+// BackendQueueStat tells the state of the spill queue of a backend and of
+// its replay.
+type BackendQueueStat struct {
+	*QueueStat
+	Name       string  `json:"name"`
+	Active     bool    `json:"active"`
+	Replaying  bool    `json:"replaying"`
+	Paused     bool    `json:"paused"`
+	Replayed   int64   `json:"replayed"`   // records since started
+	ReplayRate float64 `json:"replayRate"` // records a second
+}
+
+// updateReplayRate measures the records replayed a second since the last
+// update.
+func (bs *Backend) updateReplayRate() {
+	bs.rateLock.Lock()
+	defer bs.rateLock.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(bs.rateSince).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	replayed := atomic.LoadInt64(&bs.replayed)
+	bs.replayRate = float64(replayed-bs.rateReplayed) / elapsed
+	bs.rateSince, bs.rateReplayed = now, replayed
+}
+
+func (bs *Backend) QueueStat() (stat *BackendQueueStat, err error) {
+	qs, err := bs.fileBackend.Stat()
+	if err != nil {
+		return
+	}
+	bs.rateLock.Lock()
+	rate := bs.replayRate
+	bs.rateLock.Unlock()
+	return &BackendQueueStat{
+		QueueStat:  qs,
+		Active:     bs.HttpBackend.IsActive(),
+		Replaying:  atomic.LoadInt32(&bs.rewriterRunning) != 0,
+		Paused:     atomic.LoadInt32(&bs.replayPaused) != 0,
+		Replayed:   atomic.LoadInt64(&bs.replayed),
+		ReplayRate: rate,
+	}, nil
+}
+
+// PauseReplay stops the rewrite loop after the record it is at.
+func (bs *Backend) PauseReplay() {
+	atomic.StoreInt32(&bs.replayPaused, 1)
+}
+
+func (bs *Backend) ResumeReplay() {
+	atomic.StoreInt32(&bs.replayPaused, 0)
+	bs.startRewrite()
+}
+
+// ForceRewrite replays now rather than at the next interval, even if the
+// backend looks down.
+func (bs *Backend) ForceRewrite() (err error) {
+	if atomic.LoadInt32(&bs.replayPaused) != 0 {
+		return ErrReplayPaused
+	}
+	select {
+	case bs.chRewrite <- struct{}{}:
+	default:
+	}
+	bs.startRewrite()
+	return
+}
+
+// PurgeQueue drops the spill queue.
+func (bs *Backend) PurgeQueue() (err error) {
+	return bs.fileBackend.Purge()
+}
+
+func (ic *InfluxCluster) backend(name string) (bs *Backend, err error) {
+	ic.lock.RLock()
+	defer ic.lock.RUnlock()
+	bs, ok := ic.backends[name].(*Backend)
+	if !ok {
+		return nil, ErrBackendNotExist
+	}
+	return
+}
+
+func (ic *InfluxCluster) BackendQueueStat(name string) (stat *BackendQueueStat, err error) {
+	bs, err := ic.backend(name)
+	if err != nil {
+		return
+	}
+	stat, err = bs.QueueStat()
+	if err != nil {
+		return
+	}
+	stat.Name = name
+	return
+}
+
+func (ic *InfluxCluster) PauseReplay(name string) (err error) {
+	bs, err := ic.backend(name)
+	if err != nil {
+		return
+	}
+	bs.PauseReplay()
+	return
+}
+
+func (ic *InfluxCluster) ResumeReplay(name string) (err error) {
+	bs, err := ic.backend(name)
+	if err != nil {
+		return
+	}
+	bs.ResumeReplay()
+	return
+}
+
+func (ic *InfluxCluster) ForceRewrite(name string) (err error) {
+	bs, err := ic.backend(name)
+	if err != nil {
+		return
+	}
+	return bs.ForceRewrite()
+}
+
+func (ic *InfluxCluster) PurgeQueue(name string) (err error) {
+	bs, err := ic.backend(name)
+	if err != nil {
+		return
+	}
+	return bs.PurgeQueue()
+}
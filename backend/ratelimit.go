@@ -0,0 +1,52 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimiter paces a flow to rate units a second, in bursts of up to a
+// second's worth. A nil one doesn't limit.
+type rateLimiter struct {
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// reserve takes n units, and tells how long to wait before using them.
+func (rl *rateLimiter) reserve(n int) time.Duration {
+	if rl == nil {
+		return 0
+	}
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	now := time.Now()
+	rl.tokens = math.Min(rl.rate, rl.tokens+now.Sub(rl.last).Seconds()*rl.rate)
+	rl.last = now
+	rl.tokens -= float64(n)
+	if rl.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+}
+
+// wait blocks until n units may be used.
+func (rl *rateLimiter) wait(n int) {
+	if d := rl.reserve(n); d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrDatabaseNotFound = errors.New("database not found")
+)
+
+// routeTable routes the measurements of one database to backends.
+type routeTable struct {
+	db                    string
+	keymaps               map[string][]string
+	measurementToBackends map[string][]BackendApi // measurements to backends
+	patternToBackends     []*patternRoute         // measurement patterns to backends, in order
+	measurementToShards   map[string]*shardRoute  // sharded measurements to their hash ring
+}
+
+func newRouteTable(db string, cfg *DatabaseConfig, backends map[string]BackendApi) (rt *routeTable, err error) {
+	rt = &routeTable{db: db, keymaps: cfg.Keymaps}
+
+	rt.measurementToBackends, err = loadMeasurements(cfg.Keymaps, backends)
+	if err != nil {
+		return
+	}
+	rt.patternToBackends, err = loadPatterns(cfg.PatternKeymaps, backends)
+	if err != nil {
+		return
+	}
+	rt.measurementToShards, err = loadShards(cfg.ShardKeymaps, backends)
+	return
+}
+
+func loadMeasurements(keymaps map[string][]string, backends map[string]BackendApi) (measurementToBackends map[string][]BackendApi, err error) {
+	measurementToBackends = make(map[string][]BackendApi)
+
+	var cnt = 0
+	for measurementName, backendNames := range keymaps {
+		var backendList []BackendApi
+		for _, backendName := range backendNames {
+			backend, ok := backends[backendName]
+			if !ok {
+				err = ErrBackendNotExist
+				log.Println(backendName, err)
+				continue
+			}
+			backendList = append(backendList, backend)
+		}
+		cnt += 1
+		measurementToBackends[measurementName] = backendList
+	}
+	log.Printf("%d measurements loaded.", cnt)
+	return
+}
+
+func loadPatterns(rules []PatternKeymap, backends map[string]BackendApi) (patternToBackends []*patternRoute, err error) {
+	for i := range rules {
+		rule := &rules[i]
+		var r *regexp.Regexp
+		r, err = CompilePattern(rule)
+		if err != nil {
+			log.Printf("compile pattern %s %s error: %s", rule.Type, rule.Pattern, err)
+			return
+		}
+		route := &patternRoute{rule: rule, regexp: r}
+		for _, backendName := range rule.Backends {
+			backend, ok := backends[backendName]
+			if !ok {
+				err = ErrBackendNotExist
+				log.Println(backendName, err)
+				return nil, err
+			}
+			route.backends = append(route.backends, backend)
+		}
+		patternToBackends = append(patternToBackends, route)
+	}
+	log.Printf("%d patterns loaded.", len(patternToBackends))
+	return
+}
+
+func loadShards(rules map[string]ShardKeymap, backends map[string]BackendApi) (measurementToShards map[string]*shardRoute, err error) {
+	measurementToShards = make(map[string]*shardRoute)
+	for measurementName := range rules {
+		rule := rules[measurementName]
+		route := &shardRoute{rule: &rule, backends: make(map[string]BackendApi)}
+		var names []string
+		for _, backendName := range rule.Backends {
+			backend, ok := backends[backendName]
+			if !ok {
+				err = ErrBackendNotExist
+				log.Println(backendName, err)
+				return nil, err
+			}
+			route.backends[backendName] = backend
+			names = append(names, backendName)
+		}
+		route.ring = NewHashRing(names)
+		measurementToShards[measurementName] = route
+	}
+	log.Printf("%d sharded measurements loaded.", len(measurementToShards))
+	return
+}
+
+// GetBackends looks up exact keymaps first, then the first matching
+// pattern keymap, then _default_.
+func (rt *routeTable) GetBackends(key string) (backends []BackendApi, ok bool) {
+	backends, _, ok = rt.lookup(key)
+	return
+}
+
+func (rt *routeTable) lookup(key string) (backends []BackendApi, rule *PatternKeymap, ok bool) {
+	backends, ok = rt.measurementToBackends[key]
+	if ok {
+		return backends, &PatternKeymap{Type: RuleExact, Pattern: key, Backends: rt.keymaps[key]}, true
+	}
+	for _, route := range rt.patternToBackends {
+		if route.regexp.MatchString(key) {
+			return route.backends, route.rule, true
+		}
+	}
+	backends, ok = rt.measurementToBackends["_default_"]
+	if ok {
+		return backends, &PatternKeymap{Type: RuleDefault, Backends: rt.keymaps["_default_"]}, true
+	}
+	return
+}
+
+func (rt *routeTable) GetShard(key string) (shard *shardRoute, ok bool) {
+	shard, ok = rt.measurementToShards[key]
+	return
+}
+
+// resolveGroups returns the replica groups holding a measurement. A sharded
+// measurement is held by every one of its backends.
+func (rt *routeTable) resolveGroups(key string) (groups [][]BackendApi, ok bool) {
+	if shard, sharded := rt.GetShard(key); sharded {
+		for _, api := range shard.AllBackends() {
+			groups = append(groups, []BackendApi{api})
+		}
+		return groups, true
+	}
+	backends, ok := rt.GetBackends(key)
+	if ok {
+		groups = append(groups, backends)
+	}
+	return
+}
+
+// allGroups returns every distinct replica group of the routing table
+// which has a backend to query.
+func (rt *routeTable) allGroups() (groups [][]BackendApi) {
+	distinct := make(map[string]bool)
+	add := func(group []BackendApi) {
+		key := groupKey(group)
+		if distinct[key] {
+			return
+		}
+		queryable := false
+		for _, api := range group {
+			if !api.IsWriteOnly() {
+				queryable = true
+			}
+		}
+		if !queryable {
+			return
+		}
+		distinct[key] = true
+		groups = append(groups, group)
+	}
+	for _, backends := range rt.measurementToBackends {
+		add(backends)
+	}
+	for _, route := range rt.patternToBackends {
+		add(route.backends)
+	}
+	for _, shard := range rt.measurementToShards {
+		for _, api := range shard.AllBackends() {
+			add([]BackendApi{api})
+		}
+	}
+	return
+}
+
+// defaultGroup returns the replica group of _default_, or else the first
+// group holding the database, to ask what the backends share.
+func (rt *routeTable) defaultGroup() (group []BackendApi, ok bool) {
+	if backends, ok := rt.measurementToBackends["_default_"]; ok && len(backends) > 0 {
+		return backends, true
+	}
+	groups := rt.allGroups()
+	if len(groups) == 0 {
+		return
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groupKey(groups[i]) < groupKey(groups[j])
+	})
+	return groups[0], true
+}
+
+// keymapOf names the keymap group a measurement is routed by: the keymap
+// key or pattern, _default_, or the sharded measurement.
+func (rt *routeTable) keymapOf(key string) string {
+	route := rt.GetRoute(key)
+	switch route.Type {
+	case RuleDefault:
+		return "_default_"
+	case RuleShard:
+		return key
+	}
+	return route.Pattern
+}
+
+func (rt *routeTable) GetRoute(key string) (route *RouteMetadata) {
+	route = &RouteMetadata{Database: rt.db, Measurement: key, Backends: []string{}}
+	if shard, ok := rt.measurementToShards[key]; ok {
+		route.Type = RuleShard
+		route.Pattern = strings.Join(shard.rule.Tags, ",")
+		route.Backends = shard.rule.Backends
+		return
+	}
+	_, rule, ok := rt.lookup(key)
+	if !ok {
+		return
+	}
+	route.Type = rule.Type
+	route.Pattern = rule.Pattern
+	route.Backends = rule.Backends
+	return
+}
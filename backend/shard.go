@@ -0,0 +1,232 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/influxdata/influxql"
+)
+
+const (
+	VirtualNodes = 160
+)
+
+// HashRing is a consistent hash ring over backend names.
+type HashRing struct {
+	hashes []uint32
+	nodes  map[uint32]string
+	names  []string
+}
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum32()
+}
+
+func NewHashRing(names []string) (ring *HashRing) {
+	ring = &HashRing{
+		nodes: make(map[uint32]string),
+	}
+	for _, name := range names {
+		ring.names = append(ring.names, name)
+		for i := 0; i < VirtualNodes; i++ {
+			h := hashString(name + "#" + strconv.Itoa(i))
+			if _, ok := ring.nodes[h]; ok {
+				continue
+			}
+			ring.nodes[h] = name
+			ring.hashes = append(ring.hashes, h)
+		}
+	}
+	sort.Slice(ring.hashes, func(i, j int) bool { return ring.hashes[i] < ring.hashes[j] })
+	return
+}
+
+// Get returns n distinct names clockwise from the position of key.
+func (ring *HashRing) Get(key string, n int) (names []string) {
+	if len(ring.hashes) == 0 {
+		return
+	}
+	if n > len(ring.names) {
+		n = len(ring.names)
+	}
+	h := hashString(key)
+	start := sort.Search(len(ring.hashes), func(i int) bool { return ring.hashes[i] >= h })
+	seen := make(map[string]bool, n)
+	for i := 0; len(names) < n && i < len(ring.hashes); i++ {
+		name := ring.nodes[ring.hashes[(start+i)%len(ring.hashes)]]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return
+}
+
+type shardRoute struct {
+	rule     *ShardKeymap
+	ring     *HashRing
+	backends map[string]BackendApi
+}
+
+// HashKey is the measurement followed by the shard tags in configured order.
+func (sr *shardRoute) HashKey(measurement string, tags map[string]string) string {
+	var b strings.Builder
+	b.WriteString(measurement)
+	for _, k := range sr.rule.Tags {
+		b.WriteByte(',')
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(tags[k])
+	}
+	return b.String()
+}
+
+func (sr *shardRoute) GetBackends(measurement string, tags map[string]string) (backends []BackendApi) {
+	for _, name := range sr.ring.Get(sr.HashKey(measurement, tags), sr.rule.Replication) {
+		backends = append(backends, sr.backends[name])
+	}
+	return
+}
+
+// AllBackends returns every backend the measurement is sharded over.
+func (sr *shardRoute) AllBackends() (backends []BackendApi) {
+	for _, name := range sr.ring.names {
+		backends = append(backends, sr.backends[name])
+	}
+	return
+}
+
+// PinnedTags returns the values of keys fixed by equality tests in the
+// top-level AND chain of cond; ok is false unless all keys are pinned.
+func PinnedTags(cond influxql.Expr, keys []string) (tags map[string]string, ok bool) {
+	tags = make(map[string]string)
+	collectPinnedTags(cond, tags)
+	for _, k := range keys {
+		if _, ok = tags[k]; !ok {
+			return
+		}
+	}
+	return tags, true
+}
+
+func collectPinnedTags(expr influxql.Expr, tags map[string]string) {
+	switch e := expr.(type) {
+	case *influxql.ParenExpr:
+		collectPinnedTags(e.Expr, tags)
+	case *influxql.BinaryExpr:
+		switch e.Op {
+		case influxql.AND:
+			collectPinnedTags(e.LHS, tags)
+			collectPinnedTags(e.RHS, tags)
+		case influxql.EQ:
+			ref, ok := e.LHS.(*influxql.VarRef)
+			lit, ok2 := e.RHS.(*influxql.StringLiteral)
+			if !ok || !ok2 {
+				ref, ok = e.RHS.(*influxql.VarRef)
+				lit, ok2 = e.LHS.(*influxql.StringLiteral)
+			}
+			if ok && ok2 {
+				tags[ref.Val] = lit.Val
+			}
+		}
+	}
+}
+
+// MergeableAcrossShards tells if the answers of every shard to stmt can be
+// joined into the answer of the whole measurement. Aggregates and limits
+// are computed by each shard on its own points, so they are only right if
+// each group of series lives on one shard, that is, grouped by all keys.
+func MergeableAcrossShards(stmt influxql.Statement, keys []string) bool {
+	switch s := stmt.(type) {
+	case *influxql.SelectStatement:
+		if s.SLimit > 0 || s.SOffset > 0 {
+			return false
+		}
+		if groupedByTags(s, keys) {
+			return true
+		}
+		if s.Limit > 0 || s.Offset > 0 {
+			return false
+		}
+		aggregate := false
+		influxql.WalkFunc(s.Fields, func(n influxql.Node) {
+			if _, ok := n.(*influxql.Call); ok {
+				aggregate = true
+			}
+		})
+		return !aggregate
+	case *influxql.ShowSeriesStatement:
+		return s.Limit == 0 && s.Offset == 0
+	case *influxql.ShowTagKeysStatement:
+		return s.Limit == 0 && s.Offset == 0 && s.SLimit == 0 && s.SOffset == 0
+	case *influxql.ShowTagValuesStatement:
+		return s.Limit == 0 && s.Offset == 0
+	case *influxql.ShowFieldKeysStatement:
+		return s.Limit == 0 && s.Offset == 0
+	}
+	return true
+}
+
+func groupedByTags(s *influxql.SelectStatement, keys []string) bool {
+	if s.HasDimensionWildcard() {
+		return true
+	}
+	dims := make(map[string]bool)
+	for _, d := range s.Dimensions {
+		if ref, ok := d.Expr.(*influxql.VarRef); ok {
+			dims[ref.Val] = true
+		}
+	}
+	for _, k := range keys {
+		if !dims[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// selectShardTags adds to a select the shard tags it neither groups by nor
+// selects, so that identical rows from several backends are copies of one
+// point rather than points of series on different shards. It returns the
+// tags added, to be dropped from the merged answer.
+func selectShardTags(stmt influxql.Statement, keys []string) (added []string) {
+	s, ok := stmt.(*influxql.SelectStatement)
+	if !ok || s.HasDimensionWildcard() {
+		return
+	}
+	selected := make(map[string]bool)
+	for _, d := range s.Dimensions {
+		if ref, ok := d.Expr.(*influxql.VarRef); ok {
+			selected[ref.Val] = true
+		}
+	}
+	for _, f := range s.Fields {
+		switch e := f.Expr.(type) {
+		case *influxql.Wildcard:
+			// tags not grouped by are selected already.
+			if e.Type != influxql.FIELD {
+				return
+			}
+		case *influxql.VarRef:
+			selected[e.Val] = true
+		}
+	}
+	for _, k := range keys {
+		if selected[k] {
+			continue
+		}
+		selected[k] = true
+		s.Fields = append(s.Fields, &influxql.Field{Expr: &influxql.VarRef{Val: k, Type: influxql.Tag}})
+		added = append(added, k)
+	}
+	return
+}
@@ -0,0 +1,277 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/influxdata/influxql"
+)
+
+func TestHashRing(t *testing.T) {
+	ring := NewHashRing([]string{"node1", "node2", "node3"})
+
+	counter := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("cpu,host=server%d", i)
+		names := ring.Get(key, 2)
+		if len(names) != 2 || names[0] == names[1] {
+			t.Errorf("bad replicas for %s: %v", key, names)
+			return
+		}
+		again := ring.Get(key, 2)
+		if again[0] != names[0] || again[1] != names[1] {
+			t.Errorf("unstable replicas for %s: %v, %v", key, names, again)
+			return
+		}
+		counter[names[0]]++
+	}
+	for name, cnt := range counter {
+		if cnt < 500 {
+			t.Errorf("unbalanced ring, %s got %d of 3000", name, cnt)
+		}
+	}
+
+	if names := ring.Get("cpu", 5); len(names) != 3 {
+		t.Errorf("replicas should be capped by nodes: %v", names)
+	}
+}
+
+func TestPinnedTags(t *testing.T) {
+	tests := []struct {
+		query  string
+		pinned bool
+	}{
+		{"SELECT * FROM cpu WHERE host = 'a' AND region = 'b' AND time > now() - 1m", true},
+		{"SELECT * FROM cpu WHERE (host = 'a') AND ('b' = region)", true},
+		{"SELECT * FROM cpu WHERE host = 'a'", false},
+		{"SELECT * FROM cpu WHERE host = 'a' OR region = 'b'", false},
+		{"SELECT * FROM cpu WHERE host =~ /a/ AND region = 'b'", false},
+		{"SELECT * FROM cpu", false},
+	}
+	for _, tt := range tests {
+		stmt, err := influxql.ParseStatement(tt.query)
+		if err != nil {
+			t.Errorf("error: %s", err)
+			continue
+		}
+		_, pinned := PinnedTags(stmt.(*influxql.SelectStatement).Condition, []string{"host", "region"})
+		if pinned != tt.pinned {
+			t.Errorf("%s pinned: %v, want %v", tt.query, pinned, tt.pinned)
+		}
+	}
+}
+
+func TestMergeableAcrossShards(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"SELECT * FROM cpu", true},
+		{"SELECT value FROM cpu WHERE time > now() - 1h", true},
+		{"SELECT mean(value) FROM cpu", false},
+		{"SELECT max(value) FROM cpu GROUP BY time(1m)", false},
+		{"SELECT max(value) FROM cpu GROUP BY time(1m), host", false},
+		{"SELECT max(value) FROM cpu GROUP BY time(1m), host, region", true},
+		{"SELECT sum(value) FROM cpu GROUP BY *", true},
+		{"SELECT * FROM cpu LIMIT 10", false},
+		{"SELECT * FROM cpu OFFSET 10", false},
+		{"SELECT * FROM cpu GROUP BY host, region LIMIT 10", true},
+		{"SELECT * FROM cpu GROUP BY host, region SLIMIT 10", false},
+		{"SHOW TAG VALUES FROM cpu WITH KEY = host", true},
+		{"SHOW TAG VALUES FROM cpu WITH KEY = host LIMIT 5", false},
+		{"SHOW SERIES FROM cpu OFFSET 5", false},
+	}
+	for _, tt := range tests {
+		stmt, err := influxql.ParseStatement(tt.query)
+		if err != nil {
+			t.Errorf("error: %s", err)
+			continue
+		}
+		if got := MergeableAcrossShards(stmt, []string{"host", "region"}); got != tt.want {
+			t.Errorf("%s mergeable: %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestInfluxClusterShard(t *testing.T) {
+	cfg1, ts1 := CreateTestBackendConfig(t, "test1")
+	defer ts1.Close()
+	cfg2, ts2 := CreateTestBackendConfig(t, "test2")
+	defer ts2.Close()
+	config := &Config{
+		Proxy: ProxyConfig{DataDir: t.TempDir()},
+		Backends: map[string]BackendConfig{
+			"test1": *cfg1,
+			"test2": *cfg2,
+		},
+		Keymaps: map[string][]string{
+			"mem": {"test1"},
+		},
+		ShardKeymaps: map[string]ShardKeymap{
+			"cpu": {Tags: []string{"host"}, Backends: []string{"test1", "test2"}, Replication: 1},
+		},
+	}
+	ic := NewInfluxCluster(config)
+	err := ic.Init()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ic.Close()
+
+	if route := ic.GetRoute("cpu"); route.Type != RuleShard {
+		t.Errorf("cpu should be sharded, got %s", route.Type)
+	}
+
+	shard, ok := ic.GetShard("cpu")
+	if !ok {
+		t.Errorf("shard not loaded")
+		return
+	}
+	hosts := make(map[BackendApi]bool)
+	for i := 0; i < 100; i++ {
+		bs := shard.GetBackends("cpu", map[string]string{"host": fmt.Sprintf("server%d", i)})
+		if len(bs) != 1 {
+			t.Errorf("want 1 replica, got %d", len(bs))
+			return
+		}
+		hosts[bs[0]] = true
+	}
+	if len(hosts) != 2 {
+		t.Errorf("points should spread over both backends")
+	}
+
+	err = ic.Write([]byte("cpu,host=server01 value=1 1434055562000000000\ncpu,host=server02 value=2 1434055562000000000\n"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{
+			name:  "pinned",
+			query: "SELECT * FROM cpu WHERE host = 'server01' AND time > now() - 1m",
+			want:  204,
+		},
+		{
+			name:  "fan_out",
+			query: "SELECT * FROM cpu WHERE time > now() - 1m",
+			want:  200,
+		},
+		{
+			name:  "fan_out_aggregate",
+			query: "SELECT count(value) FROM cpu WHERE time > now() - 1m",
+			want:  400,
+		},
+		{
+			name:  "pinned_aggregate",
+			query: "SELECT count(value) FROM cpu WHERE host = 'server01' AND time > now() - 1m",
+			want:  204,
+		},
+		{
+			name:  "grouped_aggregate",
+			query: "SELECT count(value) FROM cpu WHERE time > now() - 1m GROUP BY host",
+			want:  200,
+		},
+		{
+			name:  "sources",
+			query: "SELECT value FROM cpu, mem WHERE time > now() - 1m",
+			want:  200,
+		},
+		{
+			name:  "sources_aggregate",
+			query: "SELECT count(value) FROM cpu, mem WHERE time > now() - 1m",
+			want:  400,
+		},
+		{
+			name:  "regex_aggregate",
+			query: "SELECT count(value) FROM /cp.*/ WHERE time > now() - 1m",
+			want:  400,
+		},
+		{
+			name:  "grouped_sources_aggregate",
+			query: "SELECT count(value) FROM cpu, mem WHERE time > now() - 1m GROUP BY host",
+			want:  200,
+		},
+	}
+	for _, tt := range tests {
+		w := NewDummyResponseWriter()
+		req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+url.Values{"q": {tt.query}}.Encode(), nil)
+		_ = ic.Query(w, req)
+		if w.status != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.status, tt.want)
+		}
+	}
+}
+
+func TestInfluxClusterShardMerge(t *testing.T) {
+	// two points alike but of different hosts, the one of server01 on
+	// both replicas.
+	answer := func(rows string) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != "/query" {
+				HandlerAny(w, req)
+				return
+			}
+			if q := req.FormValue("q"); !strings.Contains(q, "host::tag") {
+				t.Errorf("shard tag not selected: %s", q)
+			}
+			_, _ = w.Write([]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value","host"],"values":` + rows + `}]}]}`))
+		}
+	}
+	cfg1, ts1 := CreateTestBackendConfig(t, "test1")
+	defer ts1.Close()
+	ts1.Config.Handler = answer(`[[1,1,"server01"],[2,1,"server01"]]`)
+	cfg2, ts2 := CreateTestBackendConfig(t, "test2")
+	defer ts2.Close()
+	ts2.Config.Handler = answer(`[[1,1,"server01"],[2,1,"server01"],[2,1,"server02"]]`)
+	config := &Config{
+		Proxy: ProxyConfig{DataDir: t.TempDir()},
+		Backends: map[string]BackendConfig{
+			"test1": *cfg1,
+			"test2": *cfg2,
+		},
+		ShardKeymaps: map[string]ShardKeymap{
+			"cpu": {Tags: []string{"host"}, Backends: []string{"test1", "test2"}, Replication: 2},
+		},
+	}
+	ic := NewInfluxCluster(config)
+	err := ic.Init()
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	defer ic.Close()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://localhost:8086/query?"+url.Values{"q": {"SELECT value FROM cpu ORDER BY time DESC"}}.Encode(), nil)
+	_ = ic.Query(w, req)
+	want := `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[2,1],[2,1],[1,1]]}]}]}`
+	if got := strings.TrimSpace(w.Body.String()); w.Code != 200 || got != want {
+		t.Errorf("got %d %s", w.Code, got)
+	}
+}
+
+func TestInfluxClusterShardUnknownBackend(t *testing.T) {
+	config := &Config{
+		Proxy: ProxyConfig{DataDir: t.TempDir()},
+		ShardKeymaps: map[string]ShardKeymap{
+			"cpu": {Tags: []string{"host"}, Backends: []string{"missing"}, Replication: 1},
+		},
+	}
+	ic := NewInfluxCluster(config)
+	err := ic.Init()
+	if err != ErrBackendNotExist {
+		t.Errorf("want %s, got %v", ErrBackendNotExist, err)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2016 Eleme. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	minWriteChunk  = 64 * 1024       // bytes, smaller writes are parsed at once
+	writePieceSize = 4 * 1024 * 1024 // bytes of a streamed write routed at once
+)
+
+// LineError is a line of a write which wasn't written, numbered from 1.
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+}
+
+// WriteError reports the lines of a synchronous write which failed. It is
+// a partial write if some other lines were written.
+type WriteError struct {
+	Lines       []*LineError
+	Dropped     int
+	Partial     bool
+	Unavailable bool // some backend failed to accept its lines
+}
+
+func (e *WriteError) Error() string {
+	msgs := make([]string, 0, len(e.Lines))
+	for _, l := range e.Lines {
+		msgs = append(msgs, l.Error())
+	}
+	msg := strings.Join(msgs, "; ")
+	if e.Partial {
+		return fmt.Sprintf("partial write: %s dropped=%d", msg, e.Dropped)
+	}
+	return msg
+}
+
+// writeGroup gathers the lines of a write per backend, so that each
+// backend gets them in one batch rather than a line at a time.
+type writeGroup struct {
+	backends []BackendApi
+	buffers  map[BackendApi]*bytes.Buffer
+	lines    map[BackendApi][]int
+}
+
+func newWriteGroup() *writeGroup {
+	return &writeGroup{
+		buffers: make(map[BackendApi]*bytes.Buffer),
+		lines:   make(map[BackendApi][]int),
+	}
+}
+
+func (wg *writeGroup) add(lineno int, line []byte, bs []BackendApi) {
+	for _, b := range bs {
+		buf, ok := wg.buffers[b]
+		if !ok {
+			buf = &bytes.Buffer{}
+			wg.buffers[b] = buf
+			wg.backends = append(wg.backends, b)
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+		wg.lines[b] = append(wg.lines[b], lineno)
+	}
+}
+
+// merge appends the lines of other, which come after those of wg.
+func (wg *writeGroup) merge(other *writeGroup) {
+	for _, b := range other.backends {
+		buf, ok := wg.buffers[b]
+		if !ok {
+			buf = &bytes.Buffer{}
+			wg.buffers[b] = buf
+			wg.backends = append(wg.backends, b)
+		}
+		buf.Write(other.buffers[b].Bytes())
+		wg.lines[b] = append(wg.lines[b], other.lines[b]...)
+	}
+}
+
+// flush hands every backend its batch. A synchronous flush waits until all
+// are accepted. It returns the errors of the lines some backend didn't
+// accept.
+func (wg *writeGroup) flush(key BatchKey, sync bool) (failed map[int]error) {
+	failed = make(map[int]error)
+	acks := make([]chan error, len(wg.backends))
+	for i, b := range wg.backends {
+		acks[i] = make(chan error, 1)
+		var err error
+		if sync {
+			err = b.WriteSync(wg.buffers[b].Bytes(), key, acks[i])
+		} else {
+			err = b.WriteKey(wg.buffers[b].Bytes(), key)
+			if err == nil {
+				acks[i] <- nil
+			}
+		}
+		if err != nil {
+			acks[i] <- err
+		}
+	}
+	for i, b := range wg.backends {
+		err := <-acks[i]
+		if err == nil {
+			continue
+		}
+		var rejected *RejectedError
+		if errors.As(err, &rejected) {
+			wg.reject(b, rejected, failed)
+			continue
+		}
+		for _, lineno := range wg.lines[b] {
+			failed[lineno] = err
+		}
+	}
+	return
+}
+
+// reject fails the lines of the batch of b the backend refused, the others
+// were written.
+func (wg *writeGroup) reject(b BackendApi, rejected *RejectedError, failed map[int]error) {
+	dead := make(map[string]bool, len(rejected.Lines))
+	for _, line := range rejected.Lines {
+		dead[string(line)] = true
+	}
+	lines := bytes.Split(wg.buffers[b].Bytes(), []byte{'\n'})
+	for i, lineno := range wg.lines[b] {
+		if dead[string(bytes.TrimSpace(lines[i]))] {
+			failed[lineno] = rejected.Err
+		}
+	}
+}
+
+// splitLines cuts p in at most n chunks of whole lines, and tells the
+// number of the first line of each, counted from 1.
+func splitLines(p []byte, n int) (chunks [][]byte, first []int) {
+	size := len(p) / n
+	if size < minWriteChunk {
+		size = minWriteChunk
+	}
+	lineno := 1
+	for len(p) > 0 {
+		end := len(p)
+		if size < end {
+			i := bytes.IndexByte(p[size:], '\n')
+			if i >= 0 {
+				end = size + i + 1
+			}
+		}
+		chunks = append(chunks, p[:end])
+		first = append(first, lineno)
+		lineno += bytes.Count(p[:end], []byte{'\n'})
+		p = p[end:]
+	}
+	return
+}
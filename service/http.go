@@ -5,17 +5,36 @@
 package service
 
 import (
+	"bytes"
 	"compress/gzip"
 	"encoding/json"
-	"io/ioutil"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/http/pprof"
+	"strconv"
 	"strings"
+	"time"
 
 	"influx_proxy/backend"
 )
 
+var (
+	ErrBodyTooLarge = errors.New("request body too large")
+)
+
+const (
+	// SyncWriteHeader asks a write to wait until its lines are accepted.
+	SyncWriteHeader = "X-Influx-Proxy-Sync"
+	// QueryTimeoutHeader overrides the query timeout of the backends, as a
+	// duration such as "30s", "0" for no limit.
+	QueryTimeoutHeader = "X-Influx-Proxy-Timeout"
+	// RetryAfter is the seconds a client refused for overload should wait.
+	RetryAfter = "1"
+)
+
 type HttpService struct {
 	db string
 	ic *backend.InfluxCluster
@@ -38,15 +57,93 @@ func (hs *HttpService) Register(mux *http.ServeMux) {
 	mux.HandleFunc("/query", hs.HandleQuery)
 	mux.HandleFunc("/write", hs.HandleWrite)
 	mux.HandleFunc("/meta", hs.HandleClusterMeta)
+	mux.HandleFunc("/deadletters", hs.HandleDeadLetters)
+	mux.HandleFunc("/deadletters/download", hs.HandleDeadLettersDownload)
+	mux.HandleFunc("/deadletters/replay", hs.HandleDeadLettersReplay)
+	mux.HandleFunc("/admin/backends/", hs.HandleBackendQueue)
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
 	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 }
 
+// checkAdmin answers 401 or 403 unless authentication is off or the user
+// is an admin.
+func (hs *HttpService) checkAdmin(w http.ResponseWriter, req *http.Request) bool {
+	user, err := hs.ic.Authenticate(req)
+	if err != nil {
+		writeError(w, 401, err)
+		return false
+	}
+	if user != nil && !user.Admin {
+		writeError(w, 403, backend.ErrPermissionDenied)
+		return false
+	}
+	return true
+}
+
+func isSyncWrite(req *http.Request) bool {
+	sync, _ := strconv.ParseBool(req.Header.Get(SyncWriteHeader))
+	return sync
+}
+
+// bodyReader reads a write body, failing with ErrBodyTooLarge past the
+// bytes left, if not negative. It keeps the error it failed with.
+type bodyReader struct {
+	r    io.Reader
+	left int64
+	err  error
+}
+
+func newBodyReader(r io.Reader, limit int64) *bodyReader {
+	if limit <= 0 {
+		limit = -1
+	}
+	return &bodyReader{r: r, left: limit}
+}
+
+func (br *bodyReader) Read(p []byte) (n int, err error) {
+	// read a byte more, to tell a body of just the limit from a longer one.
+	if br.left >= 0 && int64(len(p)) > br.left+1 {
+		p = p[:br.left+1]
+	}
+	n, err = br.r.Read(p)
+	if br.left >= 0 {
+		if int64(n) > br.left {
+			n, err = int(br.left), ErrBodyTooLarge
+		}
+		br.left -= int64(n)
+	}
+	if err != nil && err != io.EOF {
+		br.err = err
+	}
+	return
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	_ = backend.WriteResponse(w, status, &backend.Response{Err: err.Error()})
+}
+
+// writeBodyError refuses a write body too large, or which can't be read.
+func writeBodyError(w http.ResponseWriter, err error) {
+	if err == ErrBodyTooLarge {
+		writeError(w, 413, err)
+		return
+	}
+	writeError(w, 400, err)
+}
+
 func (hs *HttpService) HandleClusterMeta(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 	w.Header().Add("X-Influxdb-Version", backend.VERSION)
+	if !hs.checkAdmin(w, req) {
+		return
+	}
 
-	metadata, err := hs.ic.GetClusterMetadata()
+	query := req.URL.Query()
+	metadata, err := hs.ic.GetClusterMetadata(query.Get("db"), query["measurement"])
+	if err == backend.ErrDatabaseNotFound {
+		writeError(w, 404, err)
+		return
+	}
 	if err != nil {
 		w.WriteHeader(500)
 		_, _ = w.Write([]byte(err.Error()))
@@ -64,11 +161,198 @@ func (hs *HttpService) HandleClusterMeta(w http.ResponseWriter, req *http.Reques
 	return
 }
 
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	p, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(500)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(p)
+}
+
+func writeDeadLettersError(w http.ResponseWriter, err error) {
+	if err == backend.ErrDeadLettersNotFound {
+		writeError(w, 404, err)
+		return
+	}
+	writeError(w, 500, err)
+}
+
+// HandleDeadLetters tells how many dead letters every store holds, or with
+// name lists those of a store, from offset and up to limit. DELETE purges
+// the store.
+func (hs *HttpService) HandleDeadLetters(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	w.Header().Add("X-Influxdb-Version", backend.VERSION)
+	if !hs.checkAdmin(w, req) {
+		return
+	}
+
+	query := req.URL.Query()
+	name := query.Get("name")
+	switch req.Method {
+	case "GET":
+	case "DELETE":
+		err := hs.ic.PurgeDeadLetters(name)
+		if err != nil {
+			writeDeadLettersError(w, err)
+			return
+		}
+		w.WriteHeader(204)
+		return
+	default:
+		w.WriteHeader(405)
+		_, _ = w.Write([]byte("method not allow."))
+		return
+	}
+
+	if name == "" {
+		stats, err := hs.ic.DeadLetterStats()
+		if err != nil {
+			writeDeadLettersError(w, err)
+			return
+		}
+		writeJSON(w, 200, stats)
+		return
+	}
+
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	letters, err := hs.ic.ListDeadLetters(name, offset, limit)
+	if err != nil {
+		writeDeadLettersError(w, err)
+		return
+	}
+	writeJSON(w, 200, letters)
+}
+
+// HandleDeadLettersDownload sends the dead letters of a store as they are
+// kept, one JSON object a line.
+func (hs *HttpService) HandleDeadLettersDownload(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	w.Header().Add("X-Influxdb-Version", backend.VERSION)
+	if !hs.checkAdmin(w, req) {
+		return
+	}
+
+	name := req.URL.Query().Get("name")
+	r, err := hs.ic.DownloadDeadLetters(name)
+	if err != nil {
+		writeDeadLettersError(w, err)
+		return
+	}
+	defer r.Close()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".dlq"))
+	w.WriteHeader(200)
+	_, err = io.Copy(w, r)
+	if err != nil {
+		log.Printf("download dead letters error: %s\n", err)
+	}
+}
+
+// HandleDeadLettersReplay writes the dead letters of a store again, once
+// the keymaps or the schema are fixed.
+func (hs *HttpService) HandleDeadLettersReplay(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	w.Header().Add("X-Influxdb-Version", backend.VERSION)
+	if req.Method != "POST" {
+		w.WriteHeader(405)
+		_, _ = w.Write([]byte("method not allow."))
+		return
+	}
+	if !hs.checkAdmin(w, req) {
+		return
+	}
+
+	replayed, err := hs.ic.ReplayDeadLetters(req.URL.Query().Get("name"))
+	if err != nil {
+		writeDeadLettersError(w, err)
+		return
+	}
+	writeJSON(w, 200, map[string]int{"replayed": replayed})
+}
+
+// HandleBackendQueue serves /admin/backends/{name}/queue: GET tells the
+// state of the spill queue, POST to queue/pause, queue/resume,
+// queue/rewrite or queue/purge controls it.
+func (hs *HttpService) HandleBackendQueue(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	w.Header().Add("X-Influxdb-Version", backend.VERSION)
+	if !hs.checkAdmin(w, req) {
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/admin/backends/"), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] != "queue" {
+		writeError(w, 404, errors.New("not found"))
+		return
+	}
+	name := parts[0]
+
+	if len(parts) == 2 {
+		if req.Method != "GET" {
+			w.WriteHeader(405)
+			_, _ = w.Write([]byte("method not allow."))
+			return
+		}
+		stat, err := hs.ic.BackendQueueStat(name)
+		if err != nil {
+			writeBackendQueueError(w, err)
+			return
+		}
+		writeJSON(w, 200, stat)
+		return
+	}
+
+	if req.Method != "POST" {
+		w.WriteHeader(405)
+		_, _ = w.Write([]byte("method not allow."))
+		return
+	}
+	var err error
+	switch parts[2] {
+	case "pause":
+		err = hs.ic.PauseReplay(name)
+	case "resume":
+		err = hs.ic.ResumeReplay(name)
+	case "rewrite":
+		err = hs.ic.ForceRewrite(name)
+	case "purge":
+		err = hs.ic.PurgeQueue(name)
+	default:
+		writeError(w, 404, errors.New("not found"))
+		return
+	}
+	if err != nil {
+		writeBackendQueueError(w, err)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func writeBackendQueueError(w http.ResponseWriter, err error) {
+	switch err {
+	case backend.ErrBackendNotExist:
+		writeError(w, 404, err)
+	case backend.ErrReplayPaused:
+		writeError(w, 409, err)
+	default:
+		writeError(w, 500, err)
+	}
+}
+
 func (hs *HttpService) HandleReload(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 	w.Header().Add("X-Influxdb-Version", backend.VERSION)
+	if !hs.checkAdmin(w, req) {
+		return
+	}
 
-	err := hs.ic.Init()
+	err := hs.ic.Reload()
 	if err != nil {
 		w.WriteHeader(500)
 		_, _ = w.Write([]byte(err.Error()))
@@ -84,7 +368,6 @@ func (hs *HttpService) HandlePing(w http.ResponseWriter, req *http.Request) {
 	version, err := hs.ic.Ping()
 	if err != nil {
 		panic("WTF")
-		return
 	}
 	w.Header().Add("X-Influxdb-Version", version)
 	w.WriteHeader(200)
@@ -96,13 +379,13 @@ func (hs *HttpService) HandleQuery(w http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 	w.Header().Add("X-Influxdb-Version", backend.VERSION)
 
-	db := req.FormValue("db")
-	if hs.db != "" {
-		if db != hs.db {
-			w.WriteHeader(404)
-			_, _ = w.Write([]byte("database not exist."))
+	if s := req.Header.Get(QueryTimeoutHeader); s != "" {
+		timeout, err := time.ParseDuration(s)
+		if err != nil || timeout < 0 {
+			writeError(w, 400, fmt.Errorf("invalid %s: %q", QueryTimeoutHeader, s))
 			return
 		}
+		req = req.WithContext(backend.WithQueryTimeout(req.Context(), timeout))
 	}
 
 	q := strings.TrimSpace(req.FormValue("q"))
@@ -128,18 +411,23 @@ func (hs *HttpService) HandleWrite(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	db := req.URL.Query().Get("db")
+	query := req.URL.Query()
 
-	if hs.db != "" {
-		if db != hs.db {
-			w.WriteHeader(404)
-			_, _ = w.Write([]byte("database not exist."))
-			return
-		}
+	user, err := hs.ic.Authenticate(req)
+	if err != nil {
+		writeError(w, 401, err)
+		return
+	}
+
+	gzipped := req.Header.Get("Content-Encoding") == "gzip"
+	if !gzipped && hs.ic.MaxBodySize > 0 && req.ContentLength > hs.ic.MaxBodySize {
+		// refused before any line is routed.
+		writeError(w, 413, ErrBodyTooLarge)
+		return
 	}
 
-	body := req.Body
-	if req.Header.Get("Content-Encoding") == "gzip" {
+	var body io.Reader = req.Body
+	if gzipped {
 		b, err := gzip.NewReader(req.Body)
 		if err != nil {
 			w.WriteHeader(400)
@@ -149,20 +437,59 @@ func (hs *HttpService) HandleWrite(w http.ResponseWriter, req *http.Request) {
 		defer b.Close()
 		body = b
 	}
+	br := newBodyReader(body, hs.ic.MaxBodySize)
+	body = br
+	if hs.ic.MaxBodySize > 0 && (gzipped || req.ContentLength < 0) {
+		// a body of unknown length, gzipped or chunked, is read up to the
+		// limit before any line is routed, not to write part of a body
+		// refused.
+		var buf bytes.Buffer
+		_, _ = buf.ReadFrom(br)
+		if br.err != nil {
+			writeBodyError(w, br.err)
+			return
+		}
+		body = &buf
+	}
+	var traced bytes.Buffer
+	if hs.ic.WriteTracing != 0 {
+		body = io.TeeReader(body, &traced)
+	}
 
-	p, err := ioutil.ReadAll(body)
-	if err != nil {
-		w.WriteHeader(400)
-		_, _ = w.Write([]byte(err.Error()))
+	err = hs.ic.WriteStream(body, &backend.WriteOptions{
+		User:        user,
+		DB:          query.Get("db"),
+		RP:          query.Get("rp"),
+		Precision:   query.Get("precision"),
+		Consistency: query.Get("consistency"),
+		Sync:        hs.ic.SyncWrite != 0 || isSyncWrite(req),
+	})
+	if hs.ic.WriteTracing != 0 {
+		log.Printf("Write body received by handler: %s,the client is %s\n", traced.Bytes(), req.RemoteAddr)
+	}
+	if br.err != nil {
+		// the pieces read before the body failed are written all the same.
+		writeBodyError(w, br.err)
 		return
 	}
-
-	err = hs.ic.Write(p)
-	if err == nil {
+	switch err {
+	case nil:
 		w.WriteHeader(204)
-	}
-	if hs.ic.WriteTracing != 0 {
-		log.Printf("Write body received by handler: %s,the client is %s\n", p, req.RemoteAddr)
+	case backend.ErrPermissionDenied:
+		writeError(w, 403, err)
+	case backend.ErrDatabaseNotFound:
+		writeError(w, 404, err)
+	case backend.ErrInvalidPrecision, backend.ErrInvalidConsistency:
+		writeError(w, 400, err)
+	case backend.ErrOverloaded:
+		w.Header().Set("Retry-After", RetryAfter)
+		writeError(w, 503, err)
+	default:
+		if werr, ok := err.(*backend.WriteError); ok && !werr.Unavailable {
+			writeError(w, 400, err)
+		} else {
+			writeError(w, 500, err)
+		}
 	}
 	return
 }